@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPem writes a certificate signed by parent, or self signed when parent
+// is nil, and its key, and returns both for signing further certificates
+func testPem(t *testing.T, dir string, name string, template2 *x509.Certificate, parent *x509.Certificate, parent_key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	var err error
+
+	var key *ecdsa.PrivateKey
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent = template2
+		parent_key = key
+	}
+
+	var der []byte
+	der, err = x509.CreateCertificate(rand.Reader, template2, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var key_der []byte
+	key_der, err = x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+
+	var cert *x509.Certificate
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testCa(t *testing.T, dir string, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return testPem(t, dir, name, &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+}
+
+func testLeaf(t *testing.T, dir string, name string, ca *x509.Certificate, ca_key *ecdsa.PrivateKey, not_after time.Time) {
+	testPem(t, dir, name, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     not_after,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca, ca_key)
+}
+
+func TestNewHttpClient(t *testing.T) {
+	var err error
+
+	var dir string
+	dir = t.TempDir()
+
+	var ca *x509.Certificate
+	var ca_key *ecdsa.PrivateKey
+	ca, ca_key = testCa(t, dir, "ca")
+	testLeaf(t, dir, "server", ca, ca_key, time.Now().Add(time.Hour))
+	testLeaf(t, dir, "agent", ca, ca_key, time.Now().Add(time.Hour))
+	testLeaf(t, dir, "expired", ca, ca_key, time.Now().Add(-time.Hour))
+
+	var other *x509.Certificate
+	var other_key *ecdsa.PrivateKey
+	other, other_key = testCa(t, dir, "other")
+	testLeaf(t, dir, "stranger", other, other_key, time.Now().Add(time.Hour))
+
+	var server *httptest.Server
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	{
+		var pair tls.Certificate
+		pair, err = tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+		server.TLS.ClientCAs.AddCert(ca)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	var cases []map[string]interface{}
+	cases = []map[string]interface{}{
+		{"ca": "ca", "cert": "agent", "ok": true},
+		{"ca": "ca", "cert": "", "ok": false},
+		{"ca": "ca", "cert": "expired", "ok": false},
+		{"ca": "ca", "cert": "stranger", "ok": false},
+		{"ca": "other", "cert": "agent", "ok": false},
+	}
+
+	var item map[string]interface{}
+	for _, item = range cases {
+		var cert string
+		var key string
+		if item["cert"] != "" {
+			cert = filepath.Join(dir, item["cert"].(string)+".crt")
+			key = filepath.Join(dir, item["cert"].(string)+".key")
+		}
+
+		var client *http.Client
+		client, err = NewHttpClient(filepath.Join(dir, item["ca"].(string)+".crt"), cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response *http.Response
+		response, err = client.Get(server.URL)
+		if response != nil {
+			response.Body.Close()
+		}
+		if (err == nil) != item["ok"].(bool) {
+			t.Fatalf("%v: got %v", item, err)
+		}
+	}
+
+	// a key without its certificate, or a ca file without certificates
+	_, err = NewHttpClient("", filepath.Join(dir, "agent.crt"), "")
+	if err == nil {
+		t.Fatal("certificate without key accepted")
+	}
+	_, err = NewHttpClient(filepath.Join(dir, "agent.key"), "", "")
+	if err == nil {
+		t.Fatal("ca without certificates accepted")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// doc/passive.pcap holds one frame of each kind the passive decoders take,
+// the traffic they must ignore and frames with broken lengths
+func testFrames(t *testing.T) [][]byte {
+	var frames [][]byte
+	var err error
+	err = ReadPcap("doc/passive.pcap", func(frame []byte, seen time.Time) {
+		frames = append(frames, append([]byte(nil), frame...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func TestDecodePcap(t *testing.T) {
+	var frames [][]byte
+	frames = testFrames(t)
+
+	var want [][]map[string]string
+	want = [][]map[string]string{
+		{{"source": "dhcp", "ip": "192.168.1.50", "mac": "02:00:00:00:00:50", "name": "laptop", "vendor_class": "MSFT 5.0", "dhcp_fingerprint": "1,3,6,15,31,33,43,44,46,47,119,121,249,252"}},
+		{{"source": "dhcp", "ip": "192.168.1.51", "mac": "02:00:00:00:00:51", "name": "phone", "dhcp_fingerprint": "1,3,6,15,119,252"}},
+		nil, // dhcp release
+		{{"source": "arp", "ip": "192.168.1.60", "mac": "02:00:00:00:00:60"}},
+		nil, // arp request for another host
+		{{"source": "mdns", "ip": "192.168.1.70", "mac": "02:00:00:00:00:70", "name": "printer"}},
+		nil, // mdns goodbye
+		nil, // ipv4 total length 9
+		nil, // ipv4 header length past the packet
+		nil, // ipv4 header length 8
+		nil, // later fragment
+		nil, // udp header cut short
+		nil, // arp cut short
+		nil, // mdns compression pointer loop
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("%d frames in the fixture, want %d", len(frames), len(want))
+	}
+
+	var index int
+	var frame []byte
+	for index, frame = range frames {
+		var got []map[string]string
+		got = DecodeFrame(frame)
+		if fmt.Sprint(got) != fmt.Sprint(want[index]) {
+			t.Errorf("frame %d: got %v, want %v", index, got, want[index])
+		}
+	}
+}
+
+// every prefix of every frame, and every frame with any one of its header
+// bytes clobbered, must decode to something or nothing without panicking
+func TestDecodeMalformed(t *testing.T) {
+	var frame []byte
+	for _, frame = range testFrames(t) {
+		var n int
+		for n = 0; n <= len(frame); n++ {
+			DecodeFrame(frame[:n])
+		}
+
+		var i int
+		for i = 0; i < len(frame) && i < 64; i++ {
+			var value byte
+			for _, value = range []byte{0x00, 0x0f, 0x45, 0xff} {
+				var broken []byte
+				broken = append([]byte(nil), frame...)
+				broken[i] = value
+				DecodeFrame(broken)
+			}
+		}
+	}
+}
+
+func TestDecodeShortPayloads(t *testing.T) {
+	var src_ip netip.Addr
+	var src_mac net.HardwareAddr
+	src_ip = netip.MustParseAddr("192.168.1.70")
+	src_mac, _ = net.ParseMAC("02:00:00:00:00:70")
+
+	var n int
+	for n = 0; n < 240; n++ {
+		var payload []byte
+		payload = make([]byte, n)
+		if DecodeArp(payload) != nil || DecodeDhcp(payload) != nil || DecodeMdns(payload, src_ip, src_mac) != nil {
+			t.Fatalf("%d zero bytes decoded to something", n)
+		}
+	}
+
+	// a name whose label runs past the message
+	var err error
+	_, _, err = ReadDnsName([]byte{5, 'a', 'b'}, 0)
+	if err == nil {
+		t.Fatal("label out of bounds accepted")
+	}
+}
+
+func TestReadPcapBroken(t *testing.T) {
+	var err error
+
+	var data []byte
+	data, err = ioutil.ReadFile("doc/passive.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dir string
+	dir = t.TempDir()
+
+	var cases map[string][]byte
+	cases = map[string][]byte{
+		"short":     data[:10],
+		"truncated": data[:len(data)-5],
+		"pcapng":    append([]byte{0x0a, 0x0d, 0x0d, 0x0a}, data[4:]...),
+	}
+
+	var name string
+	var content []byte
+	for name, content = range cases {
+		var path string
+		path = filepath.Join(dir, name+".pcap")
+		ioutil.WriteFile(path, content, 0600)
+
+		err = ReadPcap(path, func(frame []byte, seen time.Time) {})
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -1,36 +1,100 @@
 package main
 
 import (
+	"./lib/bcrypt"
 	_ "./lib/go-sqlite3"
 
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata"
 )
 
 var SETTINGS = struct {
-	VERSION          string
-	DATA_SOURCE_NAME string
-	TOKEN            string
-	DEBUG            bool
+	VERSION             string
+	DATA_SOURCE_NAME    string
+	DEBUG               bool
+	SCAN_INTERVAL       time.Duration
+	OUI                 string
+	DHCP_FINGERPRINTS   string
+	LATENCY_THRESHOLD   float64
+	LOSS_THRESHOLD      float64
+	TLS_CLIENT_REQUIRED bool
 }{
-	VERSION:          "20241031",
-	DATA_SOURCE_NAME: "lnx801.db",
-	TOKEN:            "123456",
-	DEBUG:            false,
+	VERSION:             "20241031",
+	DATA_SOURCE_NAME:    "lnx801.db",
+	DEBUG:               false,
+	SCAN_INTERVAL:       1 * time.Minute,
+	OUI:                 "",
+	DHCP_FINGERPRINTS:   "",
+	LATENCY_THRESHOLD:   100,
+	LOSS_THRESHOLD:      10,
+	TLS_CLIENT_REQUIRED: false,
 }
 
+type ContextKey string
+
+const CONTEXT_TOKEN ContextKey = "token"
+const CONTEXT_USER ContextKey = "user"
+
+var TOKEN_SCOPES = []string{"report", "read", "admin"}
+var USER_ROLES = []string{"viewer", "admin"}
+
+const OFFLINE_AFTER = 5 * time.Minute
+
+// latency and loss alerts look at the average of the last pings of a device,
+// one slow reply is not an alert, and clear a bit below the threshold so a
+// device hovering around it does not flap
+const PING_WINDOW = 5
+const PING_RECOVER = 0.8
+
+const SESSION_COOKIE = "lnx801_session"
+const SESSION_TTL = 12 * time.Hour
+const LOGIN_CSRF_COOKIE = "lnx801_login_csrf"
+const PASSWORD_COST = 12
+
 var (
 	// //go:embed static/pure-min.css
 	// STATIC embed.FS
@@ -38,9 +102,28 @@ var (
 	//go:embed template/index.html
 	//go:embed template/detail.html
 	//go:embed template/distribution.html
+	//go:embed template/agents.html
+	//go:embed template/login.html
+	//go:embed template/report.html
+	//go:embed template/device.html
+	//go:embed template/groups.html
+	//go:embed template/group.html
+	//go:embed template/topology.html
 	TEMPLATE embed.FS
+
+	//go:embed data/oui.txt
+	OUI_TXT []byte
+
+	//go:embed data/dhcp_fingerprints.txt
+	DHCP_FINGERPRINTS_TXT []byte
 )
 
+// VENDORS maps the first three bytes of a mac, as hex, to its maker
+var VENDORS map[string]string
+
+// DHCP_FINGERPRINTS are the rules Classify goes through in order
+var DHCP_FINGERPRINTS []map[string]string
+
 func Skip(err error) {
 	if err != nil {
 		log.Println(err)
@@ -77,465 +160,8453 @@ func TimeTaken(started time.Time, action string) {
 	var elapsed time.Duration
 	elapsed = time.Since(started)
 	log.Printf("%v took %v\n", action, elapsed)
+
+	ObserveLatency(action, elapsed)
 }
 
-// workaround, timezone issue
-// // sql: problems with time.Time
-// https://groups.google.com/g/golang-nuts/c/4ebvN6Bgv3M
-// // fixed timezone problem for datetime types #155
-// https://github.com/mattn/go-sqlite3/pull/155
-func LocalizeTz(input time.Time) (time.Time, error) {
-	var err error
+// handlers that hold the connection open for as long as the client listens,
+// one dashboard subscribed for hours would land in the top latency bucket and
+// drag every quantile up, so they are only logged
+var STREAMING_HANDLERS = map[string]bool{"EventStream": true}
+
+func StreamTimeTaken(started time.Time, action string) {
+	log.Printf("%v streamed for %v\n", action, time.Since(started))
+}
+
+// Histogram counts observations per upper bound, Metrics sums them up into
+// the cumulative buckets Prometheus expects
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	var index int
+	var bucket float64
+	for index, bucket = range histogram.Buckets {
+		if value <= bucket {
+			histogram.Counts[index] += 1
+			break
+		}
+	}
+	histogram.Count += 1
+	histogram.Sum += value
+}
+
+var LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counters are keyed by the whole series, name plus rendered labels
+var METRICS = struct {
+	sync.Mutex
+	Counters   map[string]float64
+	Histograms map[string]*Histogram
+}{
+	Counters:   make(map[string]float64),
+	Histograms: make(map[string]*Histogram),
+}
+
+var METRIC_HELP = map[string][]string{
+	"lnx801_build_info":                    {"gauge", "Version of lnx801srv"},
+	"lnx801_device_up":                     {"gauge", "1 while a device answers its agent's scans, 0 once it is offline"},
+	"lnx801_device_last_seen_seconds":      {"gauge", "Unix time of the last heartbeat of a device"},
+	"lnx801_agent_last_report_seconds":     {"gauge", "Unix time of the last report of an agent"},
+	"lnx801_db_size_bytes":                 {"gauge", "Size of the sqlite database"},
+	"lnx801_reports_total":                 {"counter", "Reports received on /api/report by result"},
+	"lnx801_report_heartbeats_total":       {"counter", "Heartbeats stored from reports by agent"},
+	"lnx801_report_duplicates_total":       {"counter", "Heartbeats dropped because they were already stored"},
+	"lnx801_events_total":                  {"counter", "Device events by type"},
+	"lnx801_wakes_total":                   {"counter", "Wake-on-LAN packets by how they were sent and the outcome"},
+	"lnx801_http_request_duration_seconds": {"histogram", "Time taken by http handlers"},
+}
+
+func MetricLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var keys []string
+	var key string
+	for key = range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var replacer *strings.Replacer
+	replacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var pairs []string
+	for _, key = range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, replacer.Replace(labels[key])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func AddMetric(name string, labels map[string]string, delta float64) {
+	METRICS.Lock()
+	defer METRICS.Unlock()
+
+	METRICS.Counters[name+MetricLabels(labels)] += delta
+}
+
+func ObserveLatency(handler string, elapsed time.Duration) {
+	METRICS.Lock()
+	defer METRICS.Unlock()
+
+	var histogram *Histogram
+	histogram = METRICS.Histograms[handler]
+	if histogram == nil {
+		histogram = &Histogram{Buckets: LATENCY_BUCKETS, Counts: make([]uint64, len(LATENCY_BUCKETS))}
+		METRICS.Histograms[handler] = histogram
+	}
+	histogram.Observe(elapsed.Seconds())
+}
+
+// every DATETIME column holds UTC as "2006-01-02 15:04:05", which go-sqlite3
+// reads back as a UTC time.Time, convert to local time only for display
+func DbTime(input time.Time) string {
+	return input.UTC().Format("2006-01-02 15:04:05")
+}
 
-	var x string
-	x = input.Format("2006-01-02 15:04:05")
+// ParseHeartbeatTime accepts RFC3339 from current agents and the zoneless
+// local time older agents (and their spools) still send
+func ParseHeartbeatTime(value string) (time.Time, error) {
+	var err error
 
 	var output time.Time
-	output, err = time.ParseInLocation("2006-01-02 15:04:05", x, time.Local)
+	output, err = time.Parse(time.RFC3339, value)
+	if err == nil {
+		return output, nil
+	}
 
+	output, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
 	return output, err
 }
 
 func MakeHandler(next func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	// the handler name keeps latency labels bounded, paths carry ids
+	var handler string
+	handler = runtime.FuncForPC(reflect.ValueOf(next).Pointer()).Name()
+	handler = handler[strings.LastIndex(handler, ".")+1:]
+
 	return func(response http.ResponseWriter, request *http.Request) {
 		defer Catch500(response)
-		defer TimeTaken(time.Now(), request.URL.Path)
+		if STREAMING_HANDLERS[handler] {
+			defer StreamTimeTaken(time.Now(), handler)
+		} else {
+			defer TimeTaken(time.Now(), handler)
+		}
 
 		log.Println("request.URL.Path:", request.URL.Path)
 
-		if strings.HasPrefix(request.URL.Path, "/api/report_") {
-			var token string
-			token = request.Header.Get("token")
+		if strings.HasPrefix(request.URL.Path, "/api/") || request.URL.Path == "/metrics" {
+			var scope string
+			scope = ApiScope(request)
 
-			if token != SETTINGS.TOKEN {
+			// the handshake already refused certificates it could not verify,
+			// here agent routes refuse connections that brought none
+			if scope == "report" && SETTINGS.TLS_CLIENT_REQUIRED && (request.TLS == nil || len(request.TLS.VerifiedChains) == 0) {
+				log.Println("no client certificate:", request.RemoteAddr)
+				ApiError(response, 401, "client certificate required")
+				return
+			}
+
+			var token map[string]interface{}
+			token = Authenticate(request)
+
+			if token == nil {
 				Api(response, 401)
+			} else if !HasScope(token, scope) {
+				log.Println("token:", token["name"], "missing scope:", scope)
+				Api(response, 403)
 			} else {
-				next(response, request)
+				next(response, request.WithContext(context.WithValue(request.Context(), CONTEXT_TOKEN, token)))
 			}
-		} else {
+		} else if request.URL.Path == "/login" || request.URL.Path == "/favicon.ico" {
 			next(response, request)
+		} else {
+			var user map[string]interface{}
+			user = LoadSession(request)
+
+			var mutating bool
+			mutating = !(request.Method == "GET" || request.Method == "HEAD")
+
+			if user == nil {
+				if strings.HasSuffix(request.URL.Path, ".json") || mutating {
+					Api(response, 401)
+				} else {
+					http.Redirect(response, request, "/login?next="+url.QueryEscape(request.URL.RequestURI()), http.StatusSeeOther)
+				}
+			} else if mutating && subtle.ConstantTimeCompare([]byte(request.PostFormValue("csrf")), []byte(user["csrf"].(string))) != 1 {
+				log.Println("user:", user["username"], "bad csrf token")
+				Api(response, 403)
+			} else if mutating && user["role"].(string) != "admin" && request.URL.Path != "/logout" {
+				log.Println("user:", user["username"], "is not admin")
+				Api(response, 403)
+			} else {
+				next(response, request.WithContext(context.WithValue(request.Context(), CONTEXT_USER, user)))
+			}
 		}
 	}
 }
 
-func Api(response http.ResponseWriter, code int, args ...interface{}) {
+func HashToken(token string) string {
+	var sum [32]byte
+	sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewToken() string {
 	var err error
 
-	var data map[string]interface{}
-	data = map[string]interface{}{
-		"code": code,
-		"msg":  http.StatusText(code),
-	}
+	var buf []byte
+	buf = make([]byte, 24)
+	_, err = rand.Read(buf)
+	Raise(err)
 
-	if len(args) == 0 {
-	} else if len(args) == 1 {
-		data["data"] = args[0]
-	} else if len(args) == 2 {
-		data["data"] = args[0]
+	return "lnx801_" + hex.EncodeToString(buf)
+}
 
-		var key string
-		var value interface{}
+func ApiScope(request *http.Request) string {
+	if request.URL.Path == "/api/report" || request.URL.Path == "/api/register" {
+		return "report"
+	}
+	if request.Method == "GET" || request.Method == "HEAD" {
+		return "read"
+	}
+	return "admin"
+}
 
-		for key, value = range args[1].(map[string]interface{}) {
-			data[key] = value
+func HasScope(token map[string]interface{}, scope string) bool {
+	var item string
+	for _, item = range strings.Split(token["scopes"].(string), ",") {
+		if item == scope || item == "admin" {
+			return true
 		}
-	} else {
 	}
+	return false
+}
 
-	var body []byte
-	body, err = json.Marshal(data)
-	Raise(err)
-
-	log.Println("code:", code)
+// last_used_time is written at most once a minute per token, every api
+// request and metrics scrape would otherwise take the sqlite write lock
+const TOKEN_USED_EVERY = time.Minute
 
-	response.Header().Set("Content-Type", "application/json; charset=utf-8")
-	// https://github.com/golang/go/blob/go1.17.8/src/net/http/server.go#L2058
-	response.Header().Set("X-Content-Type-Options", "nosniff")
-	response.WriteHeader(code)
-	response.Write(body)
+var TOKEN_USED = struct {
+	sync.Mutex
+	Times map[int64]time.Time
+}{
+	Times: make(map[int64]time.Time),
 }
 
-func HttpStatusOk(response http.ResponseWriter, request *http.Request) {
-	response.WriteHeader(http.StatusOK)
-}
+// Authenticate returns the active api_token matching the token header or a
+// bearer Authorization header. Only sha256 hashes are stored and looked up
+// through the unique index on token_hash, timing of that lookup tells an
+// attacker about the hash of what they sent, not about any stored token.
+func Authenticate(request *http.Request) map[string]interface{} {
+	var err error
 
-func Index(response http.ResponseWriter, request *http.Request) {
-	if !(request.URL.Path == "/" || strings.HasPrefix(request.URL.Path, "/index")) {
-		Api(response, 404)
-		return
+	var token string
+	token = request.Header.Get("token")
+	if token == "" {
+		var authorization string
+		authorization = request.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			token = strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		}
+	}
+	if token == "" {
+		return nil
 	}
 
-	var err error
+	var token_hash []byte
+	token_hash = []byte(HashToken(token))
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Raise(err)
 
-	var query string
-	query = `SELECT id, ip, mac, name, heartbeat_time FROM device`
-
-	var rows *sql.Rows
-	rows, err = db.Query(query)
-	defer rows.Close()
-	Raise(err)
-
-	var devices []map[string]interface{}
-	devices = make([]map[string]interface{}, 0)
-
-	var now time.Time
-	now = time.Now()
+	var matched map[string]interface{}
+	{
+		var query string
+		query = `SELECT id, name, agent_id, token_hash, scopes FROM api_token WHERE token_hash=? AND revoke_time IS NULL`
 
-	for rows.Next() {
 		var id int64
-		var ip string
-		var mac string
 		var name string
-		var heartbeat_time time.Time
+		var agent_id string
+		var token_hash2 string
+		var scopes string
 
-		err = rows.Scan(&id, &ip, &mac, &name, &heartbeat_time)
+		err = db.QueryRow(query, string(token_hash)).Scan(&id, &name, &agent_id, &token_hash2, &scopes)
+		if err == sql.ErrNoRows {
+			return nil
+		}
 		Raise(err)
 
-		heartbeat_time, err = LocalizeTz(heartbeat_time)
-		Skip(err)
+		if subtle.ConstantTimeCompare(token_hash, []byte(token_hash2)) != 1 {
+			return nil
+		}
+		matched = map[string]interface{}{
+			"id":       id,
+			"name":     name,
+			"agent_id": agent_id,
+			"scopes":   scopes,
+		}
+	}
 
-		var heartbeat_time2 string
-		heartbeat_time2 = heartbeat_time.Format("2006-01-02 15:04:05")
+	var now time.Time
+	now = time.Now()
 
-		var time_offset time.Duration
-		var time_offset2 int
-		time_offset = now.Sub(heartbeat_time)
-		time_offset2 = int(time_offset.Seconds())
+	var used bool
+	TOKEN_USED.Lock()
+	used = now.Sub(TOKEN_USED.Times[matched["id"].(int64)]) < TOKEN_USED_EVERY
+	if !used {
+		TOKEN_USED.Times[matched["id"].(int64)] = now
+	}
+	TOKEN_USED.Unlock()
 
-		devices = append(
-			devices,
-			map[string]interface{}{
-				"id":             id,
-				"ip":             ip,
-				"mac":            mac,
-				"name":           name,
-				"heartbeat_time": heartbeat_time2,
-				"time_offset":    time_offset2,
-			},
-		)
+	if !used {
+		_, err = db.Exec(`UPDATE api_token SET last_used_time=? WHERE id=?`, DbTime(now), matched["id"])
+		Skip(err)
 	}
 
-	sort.Slice(devices, func(i int, j int) bool { return devices[i]["ip"].(string) < devices[j]["ip"].(string) })
+	return matched
+}
 
-	var data struct {
-		Devices []map[string]interface{} `json:"devices"`
+// a token bound to an agent may only speak for that agent
+func TokenAllowsAgent(request *http.Request, agent_id string) bool {
+	var token map[string]interface{}
+	token, _ = request.Context().Value(CONTEXT_TOKEN).(map[string]interface{})
+	if token == nil || token["agent_id"].(string) == "" {
+		return true
 	}
-	data.Devices = devices
+	return token["agent_id"].(string) == agent_id
+}
 
-	if strings.HasSuffix(request.URL.Path, ".json") {
-		Api(response, 200, data)
-	} else {
-		var tpl *template.Template
-		if SETTINGS.DEBUG {
-			tpl, err = template.ParseFiles("template/index.html")
-		} else {
-			tpl, err = template.ParseFS(TEMPLATE, "template/index.html")
+func CreateToken(name string, scopes string, agent_id string) (int64, string, error) {
+	var err error
+
+	var item string
+	for _, item = range strings.Split(scopes, ",") {
+		var valid bool
+		var scope string
+		for _, scope = range TOKEN_SCOPES {
+			if item == scope {
+				valid = true
+			}
 		}
-		Skip(err)
-		tpl.Execute(response, data)
+		if !valid {
+			return 0, "", errors.New(fmt.Sprintf("invalid scope %q, want one of %s", item, strings.Join(TOKEN_SCOPES, ",")))
+		}
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	if err != nil {
+		return 0, "", err
+	}
+
+	var token string
+	token = NewToken()
+
+	var query string
+	query = `INSERT INTO api_token (name, agent_id, token_hash, scopes, create_time) VALUES (?,?,?,?,?)`
+
+	var result sql.Result
+	result, err = db.Exec(query, name, agent_id, HashToken(token), scopes, DbTime(time.Now()))
+	if err != nil {
+		return 0, "", err
 	}
+
+	var id int64
+	id, err = result.LastInsertId()
+	return id, token, err
 }
 
-func Detail(response http.ResponseWriter, request *http.Request) {
+func RevokeToken(id int64) error {
 	var err error
 
-	var values url.Values
-	values = request.URL.Query()
-	log.Println("values:", values)
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	if err != nil {
+		return err
+	}
 
-	var ip string
-	ip = values.Get("ip")
-	ip = strings.TrimSpace(ip)
-	log.Println("ip:", ip)
+	var result sql.Result
+	result, err = db.Exec(`UPDATE api_token SET revoke_time=? WHERE id=? AND revoke_time IS NULL`, DbTime(time.Now()), id)
+	if err != nil {
+		return err
+	}
+
+	var rows_affected int64
+	rows_affected, err = result.RowsAffected()
+	if err == nil && rows_affected == 0 {
+		err = errors.New(fmt.Sprintf("no active token with id %d", id))
+	}
+	return err
+}
+
+// RotateToken issues a new token with the same name, scopes and agent and
+// revokes the old one
+func RotateToken(id int64) (int64, string, error) {
+	var err error
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
-	Raise(err)
+	if err != nil {
+		return 0, "", err
+	}
 
-	var now time.Time
-	now = time.Now()
+	var name string
+	var scopes string
+	var agent_id string
+	err = db.QueryRow(`SELECT name, scopes, agent_id FROM api_token WHERE id=? AND revoke_time IS NULL`, id).Scan(&name, &scopes, &agent_id)
+	if err != nil {
+		return 0, "", err
+	}
 
-	var begin_time string
-	begin_time = now.Add(-(time.Duration(1440) * time.Minute)).Format("2006-01-02 15:04:05")
-	log.Println("begin_time:", begin_time)
+	var id2 int64
+	var token string
+	id2, token, err = CreateToken(name, scopes, agent_id)
+	if err != nil {
+		return 0, "", err
+	}
 
-	var end_time string
-	end_time = now.Format("2006-01-02 15:04:05")
-	log.Println("end_time:", end_time)
+	err = RevokeToken(id)
+	return id2, token, err
+}
+
+func ListTokens() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
 
 	var query string
+	query = `SELECT id, name, agent_id, scopes, create_time, last_used_time, revoke_time FROM api_token ORDER BY id`
+
 	var rows *sql.Rows
-	if ip != "" {
-		query = `
-			SELECT id, ip, mac, name, heartbeat_time
-			FROM device_log
-			WHERE ip=? AND heartbeat_time>=? AND heartbeat_time<=?
-			ORDER BY heartbeat_time DESC
-		`
-		rows, err = db.Query(query, ip, begin_time, end_time)
-	} else {
-		query = `
-			SELECT id, ip, mac, name, heartbeat_time
-			FROM device_log
-			WHERE heartbeat_time>=? AND heartbeat_time<=?
-			ORDER BY heartbeat_time DESC
-		`
-		rows, err = db.Query(query, begin_time, end_time)
-	}
+	rows, err = db.Query(query)
 	defer rows.Close()
 	Raise(err)
 
-	var device_logs []map[string]interface{}
-	device_logs = make([]map[string]interface{}, 0)
-
+	fmt.Printf("%-6s %-20s %-20s %-20s %-20s %-20s %-20s\n", "ID", "NAME", "AGENT", "SCOPES", "CREATED", "LAST USED", "REVOKED")
 	for rows.Next() {
 		var id int64
-		var ip string
-		var mac string
 		var name string
-		var heartbeat_time time.Time
+		var agent_id string
+		var scopes string
+		var create_time time.Time
+		var last_used_time sql.NullTime
+		var revoke_time sql.NullTime
 
-		err = rows.Scan(&id, &ip, &mac, &name, &heartbeat_time)
+		err = rows.Scan(&id, &name, &agent_id, &scopes, &create_time, &last_used_time, &revoke_time)
 		Raise(err)
 
-		var heartbeat_time2 string
-		heartbeat_time2 = heartbeat_time.Format("2006-01-02 15:04:05")
+		var last_used_time2 string
+		var revoke_time2 string
+		last_used_time2 = "-"
+		revoke_time2 = "-"
+		if last_used_time.Valid {
+			last_used_time2 = last_used_time.Time.In(time.Local).Format("2006-01-02 15:04:05")
+		}
+		if revoke_time.Valid {
+			revoke_time2 = revoke_time.Time.In(time.Local).Format("2006-01-02 15:04:05")
+		}
+		if agent_id == "" {
+			agent_id = "-"
+		}
 
-		device_logs = append(
-			device_logs,
-			map[string]interface{}{
-				"id":             id,
-				"ip":             ip,
-				"mac":            mac,
-				"name":           name,
-				"heartbeat_time": heartbeat_time2,
-			},
-		)
+		fmt.Printf("%-6d %-20s %-20s %-20s %-20s %-20s %-20s\n", id, name, agent_id, scopes, create_time.In(time.Local).Format("2006-01-02 15:04:05"), last_used_time2, revoke_time2)
 	}
+}
 
-	var data struct {
-		DeviceLogs []map[string]interface{} `json:"device_logs"`
+func HashPassword(password string) (string, error) {
+	var err error
+
+	var hash []byte
+	hash, err = bcrypt.GenerateFromPassword([]byte(password), PASSWORD_COST)
+	if err != nil {
+		return "", err
 	}
-	data.DeviceLogs = device_logs
+	return string(hash), nil
+}
 
-	if strings.HasSuffix(request.URL.Path, ".json") {
-		Api(response, 200, data)
-	} else {
-		var tpl *template.Template
-		if SETTINGS.DEBUG {
-			tpl, err = template.ParseFiles("template/detail.html")
+// CheckPassword takes bcrypt hashes and the pbkdf2-sha256 ones written
+// before, those are replaced at the next login
+func CheckPassword(password string, password_hash string) bool {
+	var err error
+
+	if !strings.HasPrefix(password_hash, "pbkdf2-sha256$") {
+		err = bcrypt.CompareHashAndPassword([]byte(password_hash), []byte(password))
+		return err == nil
+	}
+
+	var fields []string
+	fields = strings.Split(password_hash, "$")
+	if len(fields) != 4 {
+		return false
+	}
+
+	var iterations int
+	iterations, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return false
+	}
+
+	var salt []byte
+	salt, err = hex.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+
+	var expected []byte
+	expected, err = hex.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+
+	var key []byte
+	key, err = pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func CreateUser(username string, password string, role string) (int64, error) {
+	var err error
+
+	var valid bool
+	var item string
+	for _, item = range USER_ROLES {
+		if item == role {
+			valid = true
+		}
+	}
+	if !valid {
+		return 0, errors.New(fmt.Sprintf("invalid role %q, want one of %s", role, strings.Join(USER_ROLES, ",")))
+	}
+	if username == "" || len(password) < 8 {
+		return 0, errors.New("username must not be empty and password must have at least 8 characters")
+	}
+
+	var password_hash string
+	password_hash, err = HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	var query string
+	query = `INSERT INTO user (username, password_hash, role, create_time) VALUES (?,?,?,?)`
+
+	var result sql.Result
+	result, err = db.Exec(query, username, password_hash, role, DbTime(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// LoadSession returns the user owning the session cookie, or nil when there is
+// no cookie or the session expired
+func LoadSession(request *http.Request) map[string]interface{} {
+	var err error
+
+	var cookie *http.Cookie
+	cookie, err = request.Cookie(SESSION_COOKIE)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = `
+		SELECT u.id, u.username, u.role, s.csrf_token
+		FROM session s JOIN user u ON u.id=s.user_id
+		WHERE s.session_hash=? AND s.expire_time>?
+	`
+
+	var id int64
+	var username string
+	var role string
+	var csrf string
+	err = db.QueryRow(query, HashToken(cookie.Value), DbTime(time.Now())).Scan(&id, &username, &role, &csrf)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	Raise(err)
+
+	return map[string]interface{}{
+		"id":       id,
+		"username": username,
+		"role":     role,
+		"csrf":     csrf,
+	}
+}
+
+func CurrentUser(request *http.Request) map[string]interface{} {
+	var user map[string]interface{}
+	user, _ = request.Context().Value(CONTEXT_USER).(map[string]interface{})
+	return user
+}
+
+// only allow redirects back into this site after login
+func SafeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func Login(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var data struct {
+		Next     string
+		Username string
+		Error    string
+		Csrf     string
+	}
+	data.Next = SafeNext(request.FormValue("next"))
+
+	// there is no session to keep the csrf token in yet, the form carries
+	// the token of a cookie and a cross site post cannot read or set it
+	var csrf_cookie *http.Cookie
+	csrf_cookie, err = request.Cookie(LOGIN_CSRF_COOKIE)
+	if err != nil || csrf_cookie.Value == "" {
+		csrf_cookie = &http.Cookie{
+			Name:     LOGIN_CSRF_COOKIE,
+			Value:    NewToken(),
+			Path:     "/login",
+			HttpOnly: true,
+			Secure:   request.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		}
+		http.SetCookie(response, csrf_cookie)
+	}
+	data.Csrf = csrf_cookie.Value
+
+	if request.Method == "POST" && subtle.ConstantTimeCompare([]byte(request.PostFormValue("csrf")), []byte(csrf_cookie.Value)) != 1 {
+		log.Println("login csrf mismatch")
+		data.Username = strings.TrimSpace(request.PostFormValue("username"))
+		data.Error = "the login form expired, try again"
+		response.WriteHeader(403)
+	} else if request.Method == "POST" {
+		var username string
+		var password string
+		username = strings.TrimSpace(request.PostFormValue("username"))
+		password = request.PostFormValue("password")
+		log.Println("username:", username)
+
+		var db *sql.DB
+		db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+		defer db.Close()
+		Raise(err)
+
+		var id int64
+		var password_hash string
+		err = db.QueryRow(`SELECT id, password_hash FROM user WHERE username=?`, username).Scan(&id, &password_hash)
+		if err != nil && err != sql.ErrNoRows {
+			Raise(err)
+		}
+
+		// hash even for unknown users so timing does not reveal which exist
+		var ok bool
+		if err == sql.ErrNoRows {
+			HashPassword(password)
+			ok = false
 		} else {
-			tpl, err = template.ParseFS(TEMPLATE, "template/detail.html")
+			ok = CheckPassword(password, password_hash)
 		}
-		Skip(err)
-		tpl.Execute(response, data)
+
+		if ok {
+			var now time.Time
+			now = time.Now()
+
+			_, err = db.Exec(`DELETE FROM session WHERE expire_time<=?`, DbTime(now))
+			Skip(err)
+
+			var session string
+			var csrf string
+			session = NewToken()
+			csrf = NewToken()
+
+			var query string
+			query = `INSERT INTO session (session_hash, user_id, csrf_token, create_time, expire_time) VALUES (?,?,?,?,?)`
+			_, err = db.Exec(query, HashToken(session), id, csrf, DbTime(now), DbTime(now.Add(SESSION_TTL)))
+			Raise(err)
+
+			_, err = db.Exec(`UPDATE user SET login_time=? WHERE id=?`, DbTime(now), id)
+			Skip(err)
+
+			if strings.HasPrefix(password_hash, "pbkdf2-sha256$") {
+				password_hash, err = HashPassword(password)
+				if err == nil {
+					_, err = db.Exec(`UPDATE user SET password_hash=? WHERE id=?`, password_hash, id)
+				}
+				Skip(err)
+			}
+
+			http.SetCookie(response, &http.Cookie{
+				Name:     SESSION_COOKIE,
+				Value:    session,
+				Path:     "/",
+				MaxAge:   int(SESSION_TTL.Seconds()),
+				HttpOnly: true,
+				Secure:   request.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(response, request, data.Next, http.StatusSeeOther)
+			return
+		}
+
+		log.Println("login failed:", username)
+		data.Username = username
+		data.Error = "invalid username or password"
+		response.WriteHeader(401)
+	}
+
+	var tpl *template.Template
+	if SETTINGS.DEBUG {
+		tpl, err = template.ParseFiles("template/login.html")
+	} else {
+		tpl, err = template.ParseFS(TEMPLATE, "template/login.html")
 	}
+	Skip(err)
+	tpl.Execute(response, data)
 }
 
-func Distribution(response http.ResponseWriter, request *http.Request) {
+func Logout(response http.ResponseWriter, request *http.Request) {
 	var err error
 
-	var values url.Values
-	values = request.URL.Query()
-	log.Println("values:", values)
+	if request.Method != "POST" {
+		Api(response, 405)
+		return
+	}
 
-	var ip string
-	ip = values.Get("ip")
-	ip = strings.TrimSpace(ip)
-	log.Println("ip:", ip)
+	var cookie *http.Cookie
+	cookie, err = request.Cookie(SESSION_COOKIE)
+	if err == nil {
+		var db *sql.DB
+		db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+		defer db.Close()
+		Raise(err)
+
+		_, err = db.Exec(`DELETE FROM session WHERE session_hash=?`, HashToken(cookie.Value))
+		Raise(err)
+	}
+
+	http.SetCookie(response, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(response, request, "/login", http.StatusSeeOther)
+}
+
+func Api(response http.ResponseWriter, code int, args ...interface{}) {
+	var err error
+
+	var data map[string]interface{}
+	data = map[string]interface{}{
+		"code": code,
+		"msg":  http.StatusText(code),
+	}
+
+	if len(args) == 0 {
+	} else if len(args) == 1 {
+		data["data"] = args[0]
+	} else if len(args) == 2 {
+		data["data"] = args[0]
+
+		var key string
+		var value interface{}
+
+		for key, value = range args[1].(map[string]interface{}) {
+			data[key] = value
+		}
+	} else {
+	}
+
+	var body []byte
+	body, err = json.Marshal(data)
+	Raise(err)
+
+	log.Println("code:", code)
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// https://github.com/golang/go/blob/go1.17.8/src/net/http/server.go#L2058
+	response.Header().Set("X-Content-Type-Options", "nosniff")
+	response.WriteHeader(code)
+	response.Write(body)
+}
+
+func HttpStatusOk(response http.ResponseWriter, request *http.Request) {
+	response.WriteHeader(http.StatusOK)
+}
+
+// ParseOui reads the IEEE MA-L registry format, only the "(hex)" lines matter
+func ParseOui(data []byte) map[string]string {
+	var vendors map[string]string
+	vendors = make(map[string]string)
+
+	var line string
+	for _, line = range strings.Split(string(data), "\n") {
+		var index int
+		index = strings.Index(line, "(hex)")
+		if index < 0 {
+			continue
+		}
+
+		var prefix string
+		prefix = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(line[:index]), "-", ""))
+		if len(prefix) != 6 {
+			continue
+		}
+		vendors[prefix] = strings.TrimSpace(line[index+len("(hex)"):])
+	}
+
+	return vendors
+}
+
+// Vendor names the maker of a mac from its OUI. Phones and laptops often use
+// random, locally administered addresses that have no maker.
+func Vendor(mac string) string {
+	var hex string
+	hex = strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+	if len(hex) < 6 {
+		return ""
+	}
+
+	var vendor string
+	vendor = VENDORS[hex[:6]]
+	if vendor == "" && strings.ContainsRune("2367ABEF", rune(hex[1])) {
+		return "random"
+	}
+	return vendor
+}
+
+// CompareIp orders addresses numerically, so .2 comes before .10, and puts
+// anything that does not parse last
+func CompareIp(a string, b string) int {
+	var err error
+
+	var addr_a netip.Addr
+	var addr_b netip.Addr
+	var err_b error
+	addr_a, err = netip.ParseAddr(a)
+	addr_b, err_b = netip.ParseAddr(b)
+
+	if err == nil && err_b == nil {
+		return addr_a.Compare(addr_b)
+	}
+	if err == nil {
+		return -1
+	}
+	if err_b == nil {
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+var INDEX_SORTS = []string{"agent", "ip", "mac", "name", "vendor", "type", "os", "owner", "location", "criticality", "heartbeat"}
+
+func CompareDevices(a map[string]interface{}, b map[string]interface{}, key string) int {
+	var label = func(device map[string]interface{}) string {
+		if device["display_name"].(string) != "" {
+			return strings.ToLower(device["display_name"].(string))
+		}
+		return strings.ToLower(device["name"].(string))
+	}
+	var rank = func(device map[string]interface{}) int {
+		var index int
+		var item string
+		for index, item = range CRITICALITIES {
+			if item == device["criticality"].(string) {
+				return index + 1
+			}
+		}
+		return 0
+	}
+
+	if key == "agent" {
+		return strings.Compare(a["agent_id"].(string), b["agent_id"].(string))
+	} else if key == "mac" || key == "vendor" || key == "owner" || key == "location" {
+		return strings.Compare(strings.ToLower(a[key].(string)), strings.ToLower(b[key].(string)))
+	} else if key == "type" {
+		return strings.Compare(a["device_type"].(string), b["device_type"].(string))
+	} else if key == "os" {
+		return strings.Compare(a["os_family"].(string), b["os_family"].(string))
+	} else if key == "name" {
+		return strings.Compare(label(a), label(b))
+	} else if key == "criticality" {
+		return rank(a) - rank(b)
+	} else if key == "heartbeat" {
+		return int(a["heartbeat_unix"].(int64) - b["heartbeat_unix"].(int64))
+	}
+	return CompareIp(a["ip"].(string), b["ip"].(string))
+}
+
+func Index(response http.ResponseWriter, request *http.Request) {
+	if !(request.URL.Path == "/" || strings.HasPrefix(request.URL.Path, "/index")) {
+		Api(response, 404)
+		return
+	}
+
+	var err error
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Raise(err)
 
-	var now time.Time
-	now = time.Now()
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
 
-	var begin_time string
-	begin_time = fmt.Sprintf("%s 00:00:00", now.AddDate(0, 0, -30).Format("2006-01-02"))
-	log.Println("begin_time:", begin_time)
+	var q string
+	var state string
+	var subnet string
+	var tag string
+	var agent_id string
+	var sort_key string
+	var order string
+	q = strings.ToLower(strings.TrimSpace(values.Get("q")))
+	state = values.Get("state")
+	subnet = strings.TrimSpace(values.Get("subnet"))
+	tag = strings.ToLower(strings.TrimSpace(values.Get("tag")))
+	agent_id = strings.TrimSpace(values.Get("agent"))
+	sort_key = values.Get("sort")
+	order = values.Get("order")
 
-	var end_time string
-	end_time = fmt.Sprintf("%s 23:59:59", now.Format("2006-01-02"))
-	log.Println("end_time:", end_time)
+	if state != "" && state != "online" && state != "offline" {
+		ApiError(response, 400, "state must be online or offline")
+		return
+	}
 
-	var dates []string
-	dates = make([]string, 0)
+	var prefix netip.Prefix
+	if subnet != "" {
+		prefix, err = netip.ParsePrefix(subnet)
+		if err != nil {
+			ApiError(response, 400, fmt.Sprintf("invalid subnet %q, want e.g. 192.168.18.0/24", subnet))
+			return
+		}
+		prefix = prefix.Masked()
+	}
+
+	if sort_key == "" {
+		sort_key = "ip"
+	}
 	{
-		var i int
-		for i = 0; i <= 30; i++ {
-			dates = append(dates, now.AddDate(0, 0, -i).Format("20060102"))
+		var ok bool
+		var item string
+		for _, item = range INDEX_SORTS {
+			ok = ok || item == sort_key
+		}
+		if !ok {
+			ApiError(response, 400, "sort must be one of "+strings.Join(INDEX_SORTS, ", "))
+			return
 		}
 	}
-	log.Println("dates:", dates)
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		ApiError(response, 400, "order must be asc or desc")
+		return
+	}
+
+	var group *DeviceGroup
+	if values.Get("group") != "" {
+		group, err = LoadDeviceGroup(db, values.Get("group"))
+		if err == sql.ErrNoRows {
+			ApiError(response, 404, "no such group")
+			return
+		}
+		Raise(err)
+	}
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"1=1"}
+	if tag != "" {
+		conditions = append(conditions, "','||device_meta.tags||',' LIKE ?")
+		args = append(args, "%,"+tag+",%")
+	}
+	if agent_id != "" {
+		conditions = append(conditions, "device.agent_id=?")
+		args = append(args, agent_id)
+	}
 
 	var query string
+	query = `
+		SELECT
+			device.id, device.agent_id, device.ip, device.mac, device.name, device.heartbeat_time,
+			device.device_type, device.os_family,
+			IFNULL(device_meta.display_name, ''), IFNULL(device_meta.owner, ''), IFNULL(device_meta.location, ''),
+			IFNULL(device_meta.tags, ''), IFNULL(device_meta.criticality, '')
+		FROM device
+		LEFT JOIN device_meta ON device_meta.device_id=device.id
+		WHERE %s
+	`
+	query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
 	var rows *sql.Rows
-	if ip != "" {
-		query = `
-			SELECT id, ip, name, heartbeat_time
-			FROM device_log
-			WHERE ip=? AND heartbeat_time>=? AND heartbeat_time<=?
-		`
-		rows, err = db.Query(query, ip, begin_time, end_time)
-	} else {
-		query = `
-			SELECT id, ip, name, heartbeat_time
-			FROM device_log
-			WHERE heartbeat_time>=? AND heartbeat_time<=?
-		`
-		rows, err = db.Query(query, begin_time, end_time)
-	}
+	rows, err = db.Query(query, args...)
 	defer rows.Close()
 	Raise(err)
 
-	var device_logs map[string]map[string]int
-	device_logs = make(map[string]map[string]int)
+	var devices []map[string]interface{}
+	devices = make([]map[string]interface{}, 0)
+
+	var now time.Time
+	now = time.Now()
 
 	for rows.Next() {
 		var id int64
+		var agent_id string
 		var ip string
+		var mac string
 		var name string
 		var heartbeat_time time.Time
+		var device_type string
+		var os_family string
+		var display_name string
+		var owner string
+		var location string
+		var tags string
+		var criticality string
 
-		err = rows.Scan(&id, &ip, &name, &heartbeat_time)
+		err = rows.Scan(&id, &agent_id, &ip, &mac, &name, &heartbeat_time, &device_type, &os_family, &display_name, &owner, &location, &tags, &criticality)
 		Raise(err)
 
-		var year_month_day string
-		year_month_day = fmt.Sprintf("%d%02d%02d", heartbeat_time.Year(), int(heartbeat_time.Month()), heartbeat_time.Day())
-		// log.Println("year_month_day:", year_month_day)
+		var heartbeat_time2 string
+		heartbeat_time2 = heartbeat_time.In(time.Local).Format("2006-01-02 15:04:05")
 
-		var hour string
-		hour = fmt.Sprintf("%02d", heartbeat_time.Hour())
-		// log.Println("hour:", hour)
+		var time_offset time.Duration
+		var time_offset2 int
+		time_offset = now.Sub(heartbeat_time)
+		time_offset2 = int(time_offset.Seconds())
 
-		var ok bool
-		_, ok = device_logs[year_month_day]
-		if ok {
-			var ok2 bool
-			_, ok2 = device_logs[year_month_day][hour]
-			if ok2 {
-				device_logs[year_month_day][hour] += 1
-			} else {
-				device_logs[year_month_day][hour] = 1
+		var vendor string
+		vendor = Vendor(mac)
+
+		if state == "online" && time_offset > OFFLINE_AFTER || state == "offline" && time_offset <= OFFLINE_AFTER {
+			continue
+		}
+		if subnet != "" {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(ip)
+			if err != nil || !prefix.Contains(addr) {
+				continue
+			}
+		}
+		if q != "" {
+			var haystack string
+			haystack = strings.ToLower(strings.Join([]string{ip, mac, name, display_name, vendor, device_type, os_family}, "\n"))
+			if !strings.Contains(haystack, q) {
+				continue
+			}
+		}
+
+		var device map[string]interface{}
+		device = map[string]interface{}{
+			"id":             id,
+			"agent_id":       agent_id,
+			"ip":             ip,
+			"mac":            mac,
+			"name":           name,
+			"heartbeat_time": heartbeat_time2,
+			"heartbeat_unix": heartbeat_time.Unix(),
+			"time_offset":    time_offset2,
+			"display_name":   display_name,
+			"owner":          owner,
+			"location":       location,
+			"tags":           SplitTags(tags),
+			"criticality":    criticality,
+			"vendor":         vendor,
+			"device_type":    device_type,
+			"os_family":      os_family,
+		}
+		if group != nil && !group.Matches(device) {
+			continue
+		}
+
+		devices = append(devices, device)
+	}
+	Raise(rows.Err())
+
+	sort.SliceStable(devices, func(i int, j int) bool {
+		var result int
+		result = CompareDevices(devices[i], devices[j], sort_key)
+		if result == 0 {
+			result = CompareIp(devices[i]["ip"].(string), devices[j]["ip"].(string))
+		}
+		if result == 0 {
+			result = strings.Compare(devices[i]["agent_id"].(string), devices[j]["agent_id"].(string))
+		}
+		if order == "desc" {
+			return result > 0
+		}
+		return result < 0
+	})
+
+	var total int64
+	err = db.QueryRow(`SELECT COUNT(*) FROM device`).Scan(&total)
+	Raise(err)
+
+	var agent_ids []string
+	agent_ids = make([]string, 0)
+	{
+		var rows *sql.Rows
+		rows, err = db.Query(`SELECT DISTINCT agent_id FROM device WHERE agent_id<>'' ORDER BY agent_id`)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var agent_id2 string
+			err = rows.Scan(&agent_id2)
+			Raise(err)
+			agent_ids = append(agent_ids, agent_id2)
+		}
+		Raise(rows.Err())
+	}
+
+	// column headers sort by themselves, a second click flips the order
+	var sorts map[string]string
+	sorts = make(map[string]string)
+	{
+		var key string
+		for _, key = range INDEX_SORTS {
+			var values2 url.Values
+			values2 = url.Values{}
+
+			var key2 string
+			for key2 = range values {
+				values2.Set(key2, values.Get(key2))
+			}
+			values2.Set("sort", key)
+			values2.Set("order", "asc")
+			if key == sort_key && order == "asc" {
+				values2.Set("order", "desc")
+			}
+			sorts[key] = "/?" + values2.Encode()
+		}
+	}
+
+	var all_tags []string
+	all_tags = make([]string, 0)
+	{
+		var rows *sql.Rows
+		rows, err = db.Query(`SELECT tags FROM device_meta WHERE tags<>''`)
+		defer rows.Close()
+		Raise(err)
+
+		var seen map[string]bool
+		seen = make(map[string]bool)
+		for rows.Next() {
+			var tags string
+			err = rows.Scan(&tags)
+			Raise(err)
+
+			var tag2 string
+			for _, tag2 = range SplitTags(tags) {
+				if !seen[tag2] {
+					seen[tag2] = true
+					all_tags = append(all_tags, tag2)
+				}
 			}
+		}
+		Raise(rows.Err())
+		sort.Strings(all_tags)
+	}
+
+	var group2 map[string]interface{}
+	if group != nil {
+		group2 = map[string]interface{}{"id": group.Id, "name": group.Fields["name"]}
+	}
+
+	var data struct {
+		User    map[string]interface{}   `json:"-"`
+		Group   map[string]interface{}   `json:"group,omitempty"`
+		Query   map[string]string        `json:"query"`
+		Tags    []string                 `json:"tags"`
+		Agents  []string                 `json:"agents"`
+		Sorts   map[string]string        `json:"-"`
+		Total   int64                    `json:"total"`
+		Devices []map[string]interface{} `json:"devices"`
+	}
+	data.User = CurrentUser(request)
+	data.Group = group2
+	data.Query = map[string]string{"q": values.Get("q"), "state": state, "subnet": subnet, "tag": tag, "agent": agent_id, "group": values.Get("group"), "sort": sort_key, "order": order}
+	data.Tags = all_tags
+	data.Agents = agent_ids
+	data.Sorts = sorts
+	data.Total = total
+	data.Devices = devices
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/index.html")
 		} else {
-			device_logs[year_month_day] = map[string]int{hour: 1}
+			tpl, err = template.ParseFS(TEMPLATE, "template/index.html")
 		}
+		Skip(err)
+		tpl.Execute(response, data)
 	}
-	log.Println("device_logs:", device_logs)
+}
 
-	var hours []string
-	hours = []string{
-		"00", "01", "02", "03", "04", "05", "06", "07", "08", "09", "10", "11",
-		"12", "13", "14", "15", "16", "17", "18", "19", "20", "21", "22", "23",
+func Detail(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var ip string
+	ip = values.Get("ip")
+	ip = strings.TrimSpace(ip)
+	log.Println("ip:", ip)
+
+	var agent_id string
+	agent_id = values.Get("agent")
+	agent_id = strings.TrimSpace(agent_id)
+	log.Println("agent_id:", agent_id)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var loc *time.Location
+	loc, err = ParseTz(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var now time.Time
+	now = time.Now().In(loc)
+
+	var from time.Time
+	var to time.Time
+	from, to, err = ParseRange(values, loc, now.Add(-24*time.Hour), now, 7*24*time.Hour)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var begin_time string
+	begin_time = DbTime(from)
+	log.Println("begin_time:", begin_time)
+
+	var end_time string
+	end_time = DbTime(to)
+	log.Println("end_time:", end_time)
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"heartbeat_time>=?", "heartbeat_time<?"}
+	args = []interface{}{begin_time, end_time}
+	if ip != "" {
+		conditions = append(conditions, "ip=?")
+		args = append(args, ip)
+	}
+	if agent_id != "" {
+		conditions = append(conditions, "agent_id=?")
+		args = append(args, agent_id)
+	}
+
+	var query string
+	query = `
+		SELECT id, agent_id, ip, mac, name, heartbeat_time
+		FROM device_log
+		WHERE %s
+		ORDER BY heartbeat_time DESC
+	`
+	query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, args...)
+	defer rows.Close()
+	Raise(err)
+
+	var device_logs []map[string]interface{}
+	device_logs = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var id int64
+		var agent_id string
+		var ip string
+		var mac string
+		var name string
+		var heartbeat_time time.Time
+
+		err = rows.Scan(&id, &agent_id, &ip, &mac, &name, &heartbeat_time)
+		Raise(err)
+
+		var heartbeat_time2 string
+		heartbeat_time2 = heartbeat_time.In(loc).Format("2006-01-02 15:04:05")
+
+		device_logs = append(
+			device_logs,
+			map[string]interface{}{
+				"id":             id,
+				"agent_id":       agent_id,
+				"ip":             ip,
+				"mac":            mac,
+				"name":           name,
+				"heartbeat_time": heartbeat_time2,
+			},
+		)
+	}
+
+	// one device is shown when both are given, it can be woken from here
+	var device map[string]interface{}
+	if ip != "" && agent_id != "" {
+		var query string
+		query = `SELECT id, agent_id, ip, mac, name, heartbeat_time FROM device WHERE agent_id=? AND ip=?`
+
+		device, err = ScanDevice(db.QueryRow(query, agent_id, ip))
+		if err == sql.ErrNoRows {
+			device = nil
+		} else {
+			Raise(err)
+		}
+	}
+
+	var data struct {
+		User       map[string]interface{}   `json:"-"`
+		Range      map[string]interface{}   `json:"range"`
+		Device     map[string]interface{}   `json:"device,omitempty"`
+		DeviceLogs []map[string]interface{} `json:"device_logs"`
+	}
+	data.User = CurrentUser(request)
+	data.Range = RangeData(values, request.URL.Path, from, to, loc)
+	data.Device = device
+	data.DeviceLogs = device_logs
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/detail.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/detail.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+// Timeline turns heartbeats into up, down and unknown bands over [From, To)
+// with the same gap rule as Availability
+type Timeline struct {
+	From     time.Time
+	To       time.Time
+	Now      time.Time
+	Interval time.Duration
+	Bands    []map[string]interface{}
+	Prev     time.Time
+	HasPrev  bool
+	UpStart  time.Time
+}
+
+func (timeline *Timeline) AddBand(state string, start time.Time, end time.Time) {
+	if start.Before(timeline.From) {
+		start = timeline.From
+	}
+	if end.After(timeline.To) {
+		end = timeline.To
+	}
+	if !end.After(start) {
+		return
+	}
+
+	if len(timeline.Bands) > 0 {
+		var last map[string]interface{}
+		last = timeline.Bands[len(timeline.Bands)-1]
+		if last["state"] == state && !last["end"].(time.Time).Before(start) {
+			last["end"] = end
+			return
+		}
+	}
+
+	timeline.Bands = append(timeline.Bands, map[string]interface{}{"state": state, "start": start, "end": end})
+}
+
+func (timeline *Timeline) Observe(heartbeat_time time.Time) {
+	if !timeline.HasPrev {
+		timeline.AddBand("unknown", timeline.From, heartbeat_time)
+		timeline.UpStart = heartbeat_time
+	} else if heartbeat_time.Sub(timeline.Prev) > 2*timeline.Interval {
+		timeline.AddBand("up", timeline.UpStart, timeline.Prev.Add(timeline.Interval))
+		timeline.AddBand("down", timeline.Prev.Add(timeline.Interval), heartbeat_time)
+		timeline.UpStart = heartbeat_time
+	}
+
+	timeline.Prev = heartbeat_time
+	timeline.HasPrev = true
+}
+
+func (timeline *Timeline) Finish() {
+	var end time.Time
+	end = timeline.To
+	if timeline.Now.Before(end) {
+		end = timeline.Now
+	}
+
+	if !timeline.HasPrev {
+		timeline.AddBand("unknown", timeline.From, end)
+	} else if end.Sub(timeline.Prev) > 2*timeline.Interval {
+		timeline.AddBand("up", timeline.UpStart, timeline.Prev.Add(timeline.Interval))
+		timeline.AddBand("down", timeline.Prev.Add(timeline.Interval), end)
+	} else {
+		timeline.AddBand("up", timeline.UpStart, end)
+	}
+}
+
+// Uptime is the share of up time where the state is known, or -1
+func (timeline *Timeline) Uptime() float64 {
+	var up time.Duration
+	var known time.Duration
+
+	var band map[string]interface{}
+	for _, band = range timeline.Bands {
+		var span time.Duration
+		span = band["end"].(time.Time).Sub(band["start"].(time.Time))
+		if band["state"] == "up" {
+			up += span
+		}
+		if band["state"] != "unknown" {
+			known += span
+		}
+	}
+
+	if known == 0 {
+		return -1
+	}
+	return float64(int64(up.Seconds()/known.Seconds()*100000)) / 1000
+}
+
+var TIMELINE_COLORS = map[string]string{
+	"up":      "#198754",
+	"down":    "#dc3545",
+	"unknown": "#e0e0e0",
+}
+
+const SVG_WIDTH = 1000
+
+// SvgTicks places about a dozen labelled ticks on round times in loc
+func SvgTicks(buf *bytes.Buffer, from time.Time, to time.Time, loc *time.Location, top int, bottom int) {
+	var span time.Duration
+	span = to.Sub(from)
+
+	var step time.Duration
+	for _, step = range []time.Duration{15 * time.Minute, 1 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour} {
+		if span/step <= 12 {
+			break
+		}
+	}
+
+	var layout string
+	layout = "15:04"
+	if step >= 24*time.Hour {
+		layout = "01-02"
+	} else if span > 24*time.Hour {
+		layout = "01-02 15:04"
+	}
+
+	var from2 time.Time
+	from2 = from.In(loc)
+
+	var tick time.Time
+	if step >= 24*time.Hour {
+		tick = time.Date(from2.Year(), from2.Month(), from2.Day(), 0, 0, 0, 0, loc)
+	} else {
+		tick = time.Date(from2.Year(), from2.Month(), from2.Day(), from2.Hour(), 0, 0, 0, loc)
+	}
+	for ; tick.Before(to); tick = tick.Add(step) {
+		if tick.Before(from) {
+			continue
+		}
+
+		var x float64
+		x = float64(tick.Sub(from)) / float64(span) * SVG_WIDTH
+		fmt.Fprintf(buf, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#6c757d" stroke-width="1"/>`, x, top, x, bottom)
+		fmt.Fprintf(buf, `<text x="%.1f" y="%d" font-size="10" fill="#6c757d">%s</text>`, x+2, bottom+10, tick.Format(layout))
+	}
+}
+
+func TimelineSvg(timeline *Timeline, loc *time.Location) template.HTML {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d 50" width="100%%">`, SVG_WIDTH)
+
+	var span time.Duration
+	span = timeline.To.Sub(timeline.From)
+
+	var band map[string]interface{}
+	for _, band = range timeline.Bands {
+		var start time.Time
+		var end time.Time
+		start = band["start"].(time.Time)
+		end = band["end"].(time.Time)
+
+		var x float64
+		var width float64
+		x = float64(start.Sub(timeline.From)) / float64(span) * SVG_WIDTH
+		width = float64(end.Sub(start)) / float64(span) * SVG_WIDTH
+
+		fmt.Fprintf(&buf, `<rect x="%.2f" y="0" width="%.2f" height="30" fill="%s"><title>%s %s - %s (%s)</title></rect>`,
+			x, width, TIMELINE_COLORS[band["state"].(string)],
+			band["state"], start.In(loc).Format("2006-01-02 15:04:05"), end.In(loc).Format("2006-01-02 15:04:05"), end.Sub(start).Round(time.Second),
+		)
+	}
+
+	SvgTicks(&buf, timeline.From, timeline.To, loc, 30, 36)
+
+	buf.WriteString(`</svg>`)
+	return template.HTML(buf.String())
+}
+
+// SparklineSvg draws values over [from, to), an empty string when there is
+// nothing to draw
+func SparklineSvg(from time.Time, to time.Time, times []time.Time, values []float64, unit string, loc *time.Location) template.HTML {
+	if len(values) == 0 {
+		return ""
+	}
+
+	var max float64
+	var value float64
+	for _, value = range values {
+		if value > max {
+			max = value
+		}
+	}
+	if max <= 0 {
+		max = 1
+	}
+
+	var span time.Duration
+	span = to.Sub(from)
+
+	var points []string
+	var index int
+	for index, value = range values {
+		var x float64
+		var y float64
+		x = float64(times[index].Sub(from)) / float64(span) * SVG_WIDTH
+		y = 40 - value/max*38
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d 56" width="100%%">`, SVG_WIDTH)
+	fmt.Fprintf(&buf, `<polyline points="%s" fill="none" stroke="#0d6efd" stroke-width="1"/>`, strings.Join(points, " "))
+	fmt.Fprintf(&buf, `<text x="2" y="10" font-size="10" fill="#6c757d">%s</text>`, template.HTMLEscapeString(fmt.Sprintf("max %.1f %s", max, unit)))
+	SvgTicks(&buf, from, to, loc, 40, 46)
+	buf.WriteString(`</svg>`)
+	return template.HTML(buf.String())
+}
+
+// Device shows the history of one device: presence timeline, latency, the
+// macs and names it reported, the ips its mac used and its recent events
+func Device(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var loc *time.Location
+	loc, err = ParseTz(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var now time.Time
+	now = time.Now().In(loc)
+
+	var from time.Time
+	var to time.Time
+	from, to, err = ParseRange(values, loc, now.Add(-24*time.Hour), now, 31*24*time.Hour)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
 	}
 
-	var data struct {
-		Dates      []string                  `json:"dates"`
-		Hours      []string                  `json:"hours"`
-		DeviceLogs map[string]map[string]int `json:"device_logs"`
-	}
-	data.Dates = dates
-	data.Hours = hours
-	data.DeviceLogs = device_logs
-	log.Println("data:", data)
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, values.Get("id"))
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	var agent_id string
+	var ip string
+	agent_id = device["agent_id"].(string)
+	ip = device["ip"].(string)
+
+	// what found it last, ping or a router the agent imports from
+	{
+		var source string
+		var latency_alert int64
+		var loss_alert int64
+		err = db.QueryRow(`SELECT source, latency_alert, loss_alert FROM device WHERE id=?`, device["id"]).Scan(&source, &latency_alert, &loss_alert)
+		Raise(err)
+		device["source"] = source
+		device["latency_alert"] = latency_alert == 1
+		device["loss_alert"] = loss_alert == 1
+	}
+
+	var timeline *Timeline
+	timeline = &Timeline{From: from, To: to, Now: now, Interval: SETTINGS.SCAN_INTERVAL}
+
+	// empty macs and names are failed lookups, not changes
+	var changes []map[string]interface{}
+	changes = make([]map[string]interface{}, 0)
+	var last map[string]string
+	last = map[string]string{"mac": "", "name": ""}
+
+	var observe = func(heartbeat_time time.Time, mac string, name string, record bool) {
+		timeline.Observe(heartbeat_time)
+
+		var field string
+		var value string
+		for field, value = range map[string]string{"mac": mac, "name": name} {
+			if value == "" || value == last[field] {
+				continue
+			}
+			if record && last[field] != "" {
+				changes = append(changes, map[string]interface{}{
+					"time":  heartbeat_time.In(loc).Format("2006-01-02 15:04:05"),
+					"field": field,
+					"from":  last[field],
+					"to":    value,
+				})
+			}
+			last[field] = value
+		}
+	}
+
+	{
+		var query string
+		query = `
+			SELECT heartbeat_time, mac, name FROM device_log
+			WHERE agent_id=? AND ip=? AND heartbeat_time<?
+			ORDER BY heartbeat_time DESC LIMIT 1
+		`
+
+		var heartbeat_time time.Time
+		var mac string
+		var name string
+		err = db.QueryRow(query, agent_id, ip, DbTime(from)).Scan(&heartbeat_time, &mac, &name)
+		if err != sql.ErrNoRows {
+			Raise(err)
+			observe(heartbeat_time, mac, name, false)
+		}
+	}
+	// heartbeats that were pings carry round trip and loss, the rest are NULL
+	var rtt_times []time.Time
+	var rtts []float64
+	var loss_times []time.Time
+	var losses []float64
+	var latency map[string]interface{}
+	latency = map[string]interface{}{"samples": 0, "probes": 0, "lossy": 0}
+	{
+		var query string
+		query = `
+			SELECT heartbeat_time, mac, name, rtt_min, rtt_avg, rtt_max, jitter, loss FROM device_log
+			WHERE agent_id=? AND ip=? AND heartbeat_time>=? AND heartbeat_time<?
+			ORDER BY heartbeat_time
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, agent_id, ip, DbTime(from), DbTime(to))
+		defer rows.Close()
+		Raise(err)
+
+		var rtt_min float64
+		var rtt_max float64
+		var rtt_sum float64
+		var jitter_sum float64
+		for rows.Next() {
+			var heartbeat_time time.Time
+			var mac string
+			var name string
+			var ping [5]sql.NullFloat64
+
+			err = rows.Scan(&heartbeat_time, &mac, &name, &ping[0], &ping[1], &ping[2], &ping[3], &ping[4])
+			Raise(err)
+
+			observe(heartbeat_time, mac, name, true)
+
+			if !ping[1].Valid {
+				continue
+			}
+			if len(rtts) == 0 || ping[0].Float64 < rtt_min {
+				rtt_min = ping[0].Float64
+			}
+			if ping[2].Float64 > rtt_max {
+				rtt_max = ping[2].Float64
+			}
+			rtt_sum += ping[1].Float64
+			jitter_sum += ping[3].Float64
+			rtt_times = append(rtt_times, heartbeat_time)
+			rtts = append(rtts, ping[1].Float64)
+		}
+		Raise(rows.Err())
+
+		if len(rtts) > 0 {
+			latency["samples"] = len(rtts)
+			latency["rtt_min"] = rtt_min
+			latency["rtt_avg"] = rtt_sum / float64(len(rtts))
+			latency["rtt_max"] = rtt_max
+			latency["jitter"] = jitter_sum / float64(len(rtts))
+		}
+	}
+	// loss also counts the pings that got no reply at all
+	{
+		var query string
+		query = `
+			SELECT heartbeat_time, loss FROM device_log
+			WHERE agent_id=? AND ip=? AND heartbeat_time>=? AND heartbeat_time<? AND loss IS NOT NULL
+			UNION ALL
+			SELECT probe_time, 100 FROM ping_loss
+			WHERE agent_id=? AND ip=? AND probe_time>=? AND probe_time<?
+			ORDER BY 1
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, agent_id, ip, DbTime(from), DbTime(to), agent_id, ip, DbTime(from), DbTime(to))
+		defer rows.Close()
+		Raise(err)
+
+		var loss_sum float64
+		var lossy int
+		for rows.Next() {
+			var probe_time time.Time
+			var loss float64
+			err = rows.Scan(&probe_time, &loss)
+			Raise(err)
+
+			loss_sum += loss
+			if loss > 0 {
+				lossy++
+			}
+			loss_times = append(loss_times, probe_time)
+			losses = append(losses, loss)
+		}
+		Raise(rows.Err())
+
+		if len(losses) > 0 {
+			latency["probes"] = len(losses)
+			latency["loss"] = loss_sum / float64(len(losses))
+			latency["lossy"] = lossy
+		}
+	}
+	timeline.Finish()
+
+	var ips []map[string]interface{}
+	ips = make([]map[string]interface{}, 0)
+	if device["mac"].(string) != "" {
+		var query string
+		query = `
+			SELECT ip, MIN(heartbeat_time), MAX(heartbeat_time), COUNT(*) FROM device_log
+			WHERE agent_id=? AND mac=? AND heartbeat_time>=? AND heartbeat_time<?
+			GROUP BY ip ORDER BY 3 DESC
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, agent_id, device["mac"], DbTime(from), DbTime(to))
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var ip2 string
+			var first_time string
+			var last_time string
+			var heartbeats int64
+
+			err = rows.Scan(&ip2, &first_time, &last_time, &heartbeats)
+			Raise(err)
+
+			var item map[string]interface{}
+			item = map[string]interface{}{"ip": ip2, "heartbeats": heartbeats}
+
+			var field string
+			var value string
+			for field, value = range map[string]string{"first_time": first_time, "last_time": last_time} {
+				var value2 time.Time
+				value2, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.UTC)
+				Skip(err)
+				item[field] = value2.In(loc).Format("2006-01-02 15:04:05")
+			}
+			ips = append(ips, item)
+		}
+		Raise(rows.Err())
+	}
+
+	var events []map[string]interface{}
+	events = make([]map[string]interface{}, 0)
+	{
+		var query string
+		query = `SELECT type, message, event_time FROM event WHERE agent_id=? AND ip=? ORDER BY event_time DESC, id DESC LIMIT 50`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, agent_id, ip)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var event_type string
+			var message string
+			var event_time time.Time
+
+			err = rows.Scan(&event_type, &message, &event_time)
+			Raise(err)
+
+			events = append(events, map[string]interface{}{
+				"type":       event_type,
+				"message":    message,
+				"event_time": event_time.In(loc).Format("2006-01-02 15:04:05"),
+			})
+		}
+		Raise(rows.Err())
+	}
+
+	var bands []map[string]interface{}
+	bands = make([]map[string]interface{}, 0)
+	{
+		var band map[string]interface{}
+		for _, band = range timeline.Bands {
+			bands = append(bands, map[string]interface{}{
+				"state": band["state"],
+				"start": FormatApiTime(band["start"].(time.Time)),
+				"end":   FormatApiTime(band["end"].(time.Time)),
+			})
+		}
+	}
+
+	var data struct {
+		User          map[string]interface{}   `json:"-"`
+		Range         map[string]interface{}   `json:"range"`
+		Device        map[string]interface{}   `json:"device"`
+		Meta          map[string]interface{}   `json:"meta"`
+		Criticalities []string                 `json:"-"`
+		Uptime        float64                  `json:"uptime"`
+		Bands         []map[string]interface{} `json:"bands"`
+		Timeline      template.HTML            `json:"-"`
+		Sparkline     template.HTML            `json:"-"`
+		LossSparkline template.HTML            `json:"-"`
+		Latency       map[string]interface{}   `json:"latency"`
+		Changes       []map[string]interface{} `json:"changes"`
+		Ips           []map[string]interface{} `json:"ips"`
+		Events        []map[string]interface{} `json:"events"`
+		Wakes         []map[string]interface{} `json:"wakes"`
+		Ports         []map[string]interface{} `json:"ports"`
+		Snmp          map[string]interface{}   `json:"snmp"`
+	}
+	data.User = CurrentUser(request)
+	data.Range = RangeData(values, request.URL.Path, from, to, loc)
+	data.Range["export"] = data.Range["export"].(string) + "&" + url.Values{"agent": {agent_id}, "ip": {ip}}.Encode()
+	data.Device = device
+	data.Meta = LoadDeviceMeta(db, device["id"].(int64))
+	data.Criticalities = CRITICALITIES
+	data.Uptime = timeline.Uptime()
+	data.Bands = bands
+	data.Timeline = TimelineSvg(timeline, loc)
+	data.Sparkline = SparklineSvg(from, to, rtt_times, rtts, "ms", loc)
+	data.LossSparkline = SparklineSvg(from, to, loss_times, losses, "%", loc)
+	data.Latency = latency
+	data.Changes = changes
+	data.Ips = ips
+	data.Events = events
+	data.Wakes = LoadWakes(db, device["id"].(int64), 10)
+	data.Ports = LoadOpenPorts(db, device["id"].(int64))
+	data.Snmp = LoadSnmp(db, device)
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/device.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/device.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+func DeviceMetaForm(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, request.PostFormValue("id"))
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	var input map[string]string
+	input = make(map[string]string)
+
+	var field string
+	for _, field = range DEVICE_META_FIELDS {
+		input[field] = request.PostFormValue(field)
+	}
+
+	var meta map[string]string
+	meta, err = ParseDeviceMeta(input)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	SaveDeviceMeta(db, device["id"].(int64), meta, CurrentUser(request)["username"].(string))
+
+	http.Redirect(response, request, fmt.Sprintf("/device?id=%d", device["id"]), http.StatusSeeOther)
+}
+
+var DEVICE_GROUP_FIELDS = []string{"name", "description", "cidrs", "vendor", "name_regex", "tag"}
+
+// DeviceGroup is a named set of devices. A device belongs to it when it was
+// added by hand or, for a group with rules, when it matches every rule.
+type DeviceGroup struct {
+	Id        int64
+	Fields    map[string]string
+	Prefixes  []netip.Prefix
+	NameRegex *regexp.Regexp
+	Members   map[int64]bool
+}
+
+// ParseDeviceGroup validates user input, rules that are missing stay empty
+func ParseDeviceGroup(input map[string]string) (map[string]string, error) {
+	var err error
+
+	var fields map[string]string
+	fields = make(map[string]string)
+
+	var field string
+	for _, field = range DEVICE_GROUP_FIELDS {
+		var value string
+		value = strings.TrimSpace(input[field])
+
+		var max int
+		max = 100
+		if field == "description" || field == "cidrs" {
+			max = 1000
+		}
+		if len(value) > max {
+			return nil, errors.New(fmt.Sprintf("%s must be at most %d bytes", field, max))
+		}
+
+		if field == "name" && value == "" {
+			return nil, errors.New("name is required")
+		}
+
+		if field == "cidrs" {
+			var prefixes []string
+			var item string
+			for _, item = range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+				var prefix netip.Prefix
+				prefix, err = netip.ParsePrefix(item)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid cidr %q, want e.g. 192.168.18.0/24", item))
+				}
+				prefixes = append(prefixes, prefix.Masked().String())
+			}
+			value = strings.Join(prefixes, ",")
+		}
+
+		if field == "name_regex" && value != "" {
+			_, err = regexp.Compile(value)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid name_regex: %s", err))
+			}
+		}
+
+		if field == "tag" && value != "" {
+			value = strings.ToLower(value)
+			if !TAG_PATTERN.MatchString(value) {
+				return nil, errors.New(fmt.Sprintf("invalid tag %q, use up to 32 of a-z 0-9 _ . -", value))
+			}
+		}
+
+		fields[field] = value
+	}
+
+	return fields, nil
+}
+
+func (group *DeviceGroup) HasRules() bool {
+	return group.Fields["cidrs"] != "" || group.Fields["vendor"] != "" || group.Fields["name_regex"] != "" || group.Fields["tag"] != ""
+}
+
+// Matches takes a device as LoadGroupDevices returns it
+func (group *DeviceGroup) Matches(device map[string]interface{}) bool {
+	if group.Members[device["id"].(int64)] {
+		return true
+	}
+	if !group.HasRules() {
+		return false
+	}
+
+	if len(group.Prefixes) > 0 {
+		var addr netip.Addr
+		var err error
+		addr, err = netip.ParseAddr(device["ip"].(string))
+		if err != nil {
+			return false
+		}
+
+		var ok bool
+		var prefix netip.Prefix
+		for _, prefix = range group.Prefixes {
+			ok = ok || prefix.Contains(addr)
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if group.Fields["vendor"] != "" && !strings.Contains(strings.ToLower(device["vendor"].(string)), strings.ToLower(group.Fields["vendor"])) {
+		return false
+	}
+
+	if group.NameRegex != nil && !group.NameRegex.MatchString(device["name"].(string)) && !group.NameRegex.MatchString(device["display_name"].(string)) {
+		return false
+	}
+
+	if group.Fields["tag"] != "" {
+		var ok bool
+		var tag string
+		for _, tag = range device["tags"].([]string) {
+			ok = ok || tag == group.Fields["tag"]
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ScanDeviceGroup(db *sql.DB, rows interface{ Scan(...interface{}) error }) (*DeviceGroup, error) {
+	var err error
+
+	var group DeviceGroup
+	var name string
+	var description string
+	var cidrs string
+	var vendor string
+	var name_regex string
+	var tag string
+	err = rows.Scan(&group.Id, &name, &description, &cidrs, &vendor, &name_regex, &tag)
+	if err != nil {
+		return nil, err
+	}
+	group.Fields = map[string]string{"name": name, "description": description, "cidrs": cidrs, "vendor": vendor, "name_regex": name_regex, "tag": tag}
+
+	var item string
+	for _, item = range strings.Split(cidrs, ",") {
+		var prefix netip.Prefix
+		prefix, err = netip.ParsePrefix(item)
+		if err == nil {
+			group.Prefixes = append(group.Prefixes, prefix)
+		}
+	}
+	if name_regex != "" {
+		group.NameRegex, err = regexp.Compile(name_regex)
+		Skip(err)
+	}
+
+	group.Members = make(map[int64]bool)
+
+	var rows2 *sql.Rows
+	rows2, err = db.Query(`SELECT device_id FROM device_group_member WHERE group_id=?`, group.Id)
+	defer rows2.Close()
+	Raise(err)
+
+	for rows2.Next() {
+		var device_id int64
+		err = rows2.Scan(&device_id)
+		Raise(err)
+		group.Members[device_id] = true
+	}
+	Raise(rows2.Err())
+
+	return &group, nil
+}
+
+func LoadDeviceGroup(db *sql.DB, id string) (*DeviceGroup, error) {
+	var err error
+
+	var id2 int64
+	id2, err = strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	var query string
+	query = `SELECT id, name, description, cidrs, vendor, name_regex, tag FROM device_group WHERE id=?`
+
+	return ScanDeviceGroup(db, db.QueryRow(query, id2))
+}
+
+func LoadDeviceGroups(db *sql.DB) []*DeviceGroup {
+	var err error
+
+	var query string
+	query = `SELECT id, name, description, cidrs, vendor, name_regex, tag FROM device_group ORDER BY name`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	defer rows.Close()
+	Raise(err)
+
+	var groups []*DeviceGroup
+	groups = make([]*DeviceGroup, 0)
+
+	for rows.Next() {
+		var group *DeviceGroup
+		group, err = ScanDeviceGroup(db, rows)
+		Raise(err)
+		groups = append(groups, group)
+	}
+	Raise(rows.Err())
+
+	return groups
+}
+
+// LoadGroupDevices returns every device with what group rules look at
+func LoadGroupDevices(db *sql.DB) []map[string]interface{} {
+	var err error
+
+	var query string
+	query = `
+		SELECT
+			device.id, device.agent_id, device.ip, device.mac, device.name, device.heartbeat_time,
+			IFNULL(device_meta.display_name, ''), IFNULL(device_meta.tags, '')
+		FROM device
+		LEFT JOIN device_meta ON device_meta.device_id=device.id
+	`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	defer rows.Close()
+	Raise(err)
+
+	var devices []map[string]interface{}
+	devices = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var id int64
+		var agent_id string
+		var ip string
+		var mac string
+		var name string
+		var heartbeat_time time.Time
+		var display_name string
+		var tags string
+
+		err = rows.Scan(&id, &agent_id, &ip, &mac, &name, &heartbeat_time, &display_name, &tags)
+		Raise(err)
+
+		devices = append(
+			devices,
+			map[string]interface{}{
+				"id":             id,
+				"agent_id":       agent_id,
+				"ip":             ip,
+				"mac":            mac,
+				"name":           name,
+				"display_name":   display_name,
+				"tags":           SplitTags(tags),
+				"vendor":         Vendor(mac),
+				"heartbeat_time": heartbeat_time.In(time.Local).Format("2006-01-02 15:04:05"),
+				"online":         time.Since(heartbeat_time) <= OFFLINE_AFTER,
+			},
+		)
+	}
+	Raise(rows.Err())
+
+	sort.Slice(devices, func(i int, j int) bool {
+		return CompareIp(devices[i]["ip"].(string), devices[j]["ip"].(string)) < 0
+	})
+
+	return devices
+}
+
+// GroupData is what pages and json show of a group and its members
+func GroupData(group *DeviceGroup, devices []map[string]interface{}) map[string]interface{} {
+	var members []map[string]interface{}
+	members = make([]map[string]interface{}, 0)
+
+	var online int
+	var device map[string]interface{}
+	for _, device = range devices {
+		if !group.Matches(device) {
+			continue
+		}
+		if device["online"].(bool) {
+			online += 1
+		}
+		members = append(members, device)
+	}
+
+	var data map[string]interface{}
+	data = map[string]interface{}{
+		"id":      group.Id,
+		"manual":  len(group.Members),
+		"members": len(members),
+		"online":  online,
+		"devices": members,
+	}
+
+	var field string
+	for _, field = range DEVICE_GROUP_FIELDS {
+		data[field] = group.Fields[field]
+	}
+
+	return data
+}
+
+func Groups(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var devices []map[string]interface{}
+	devices = LoadGroupDevices(db)
+
+	var groups []map[string]interface{}
+	groups = make([]map[string]interface{}, 0)
+
+	var group *DeviceGroup
+	for _, group = range LoadDeviceGroups(db) {
+		var group2 map[string]interface{}
+		group2 = GroupData(group, devices)
+		delete(group2, "devices")
+		groups = append(groups, group2)
+	}
+
+	var data struct {
+		User   map[string]interface{}   `json:"-"`
+		Groups []map[string]interface{} `json:"groups"`
+	}
+	data.User = CurrentUser(request)
+	data.Groups = groups
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/groups.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/groups.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+func Group(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var group *DeviceGroup
+	group, err = LoadDeviceGroup(db, request.URL.Query().Get("id"))
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such group")
+		return
+	}
+	Raise(err)
+
+	var devices []map[string]interface{}
+	devices = LoadGroupDevices(db)
+
+	var group2 map[string]interface{}
+	group2 = GroupData(group, devices)
+
+	// members added by hand can be removed, rule members only by editing rules
+	var member map[string]interface{}
+	for _, member = range group2["devices"].([]map[string]interface{}) {
+		member["manual"] = group.Members[member["id"].(int64)]
+	}
+
+	var others []map[string]interface{}
+	others = make([]map[string]interface{}, 0)
+
+	var device map[string]interface{}
+	for _, device = range devices {
+		if !group.Matches(device) {
+			others = append(others, device)
+		}
+	}
+
+	var data struct {
+		User   map[string]interface{}   `json:"-"`
+		Group  map[string]interface{}   `json:"group"`
+		Others []map[string]interface{} `json:"-"`
+	}
+	data.User = CurrentUser(request)
+	data.Group = group2
+	data.Others = others
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/group.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/group.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+// GroupForm handles the admin forms of the group pages, action is one of
+// create, update, delete, add and remove
+func GroupForm(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var action string
+	action = request.PostFormValue("action")
+
+	if action == "create" || action == "update" {
+		var input map[string]string
+		input = make(map[string]string)
+
+		var field string
+		for _, field = range DEVICE_GROUP_FIELDS {
+			input[field] = request.PostFormValue(field)
+		}
+
+		var fields map[string]string
+		fields, err = ParseDeviceGroup(input)
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+
+		var id int64
+		if action == "update" {
+			var group *DeviceGroup
+			group, err = LoadDeviceGroup(db, request.PostFormValue("id"))
+			if err == sql.ErrNoRows {
+				ApiError(response, 404, "no such group")
+				return
+			}
+			Raise(err)
+			id = group.Id
+		}
+
+		var count int64
+		err = db.QueryRow(`SELECT COUNT(*) FROM device_group WHERE name=? AND id<>?`, fields["name"], id).Scan(&count)
+		Raise(err)
+		if count > 0 {
+			ApiError(response, 409, fmt.Sprintf("group %q already exists", fields["name"]))
+			return
+		}
+
+		var update_time string
+		update_time = DbTime(time.Now())
+
+		if action == "create" {
+			var result sql.Result
+			result, err = db.Exec(
+				`INSERT INTO device_group (name, description, cidrs, vendor, name_regex, tag, create_time, update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				fields["name"], fields["description"], fields["cidrs"], fields["vendor"], fields["name_regex"], fields["tag"], update_time, update_time,
+			)
+			Raise(err)
+
+			id, err = result.LastInsertId()
+			Raise(err)
+		} else {
+			_, err = db.Exec(
+				`UPDATE device_group SET name=?, description=?, cidrs=?, vendor=?, name_regex=?, tag=?, update_time=? WHERE id=?`,
+				fields["name"], fields["description"], fields["cidrs"], fields["vendor"], fields["name_regex"], fields["tag"], update_time, id,
+			)
+			Raise(err)
+		}
+
+		http.Redirect(response, request, fmt.Sprintf("/group?id=%d", id), http.StatusSeeOther)
+		return
+	}
+
+	var group *DeviceGroup
+	group, err = LoadDeviceGroup(db, request.PostFormValue("id"))
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such group")
+		return
+	}
+	Raise(err)
+
+	if action == "delete" {
+		_, err = db.Exec(`DELETE FROM device_group_member WHERE group_id=?`, group.Id)
+		Raise(err)
+		_, err = db.Exec(`DELETE FROM device_group WHERE id=?`, group.Id)
+		Raise(err)
+
+		http.Redirect(response, request, "/groups", http.StatusSeeOther)
+		return
+	} else if action == "add" || action == "remove" {
+		var device map[string]interface{}
+		device, err = LoadDevice(db, request.PostFormValue("device_id"))
+		if err == sql.ErrNoRows {
+			ApiError(response, 404, "no such device")
+			return
+		}
+		Raise(err)
+
+		if action == "add" {
+			_, err = db.Exec(`INSERT OR IGNORE INTO device_group_member (group_id, device_id) VALUES (?, ?)`, group.Id, device["id"])
+		} else {
+			_, err = db.Exec(`DELETE FROM device_group_member WHERE group_id=? AND device_id=?`, group.Id, device["id"])
+		}
+		Raise(err)
+
+		http.Redirect(response, request, fmt.Sprintf("/group?id=%d", group.Id), http.StatusSeeOther)
+		return
+	}
+
+	ApiError(response, 400, "action must be one of create, update, delete, add, remove")
+}
+
+// ParseDhcpFingerprints reads match, device type, os family and a comment
+// separated by tabs, # starts a comment line
+func ParseDhcpFingerprints(data []byte) []map[string]string {
+	var rules []map[string]string
+	rules = make([]map[string]string, 0)
+
+	var line string
+	for _, line = range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var fields []string
+		fields = strings.Split(line, "\t")
+		if len(fields) < 3 {
+			log.Println("bad fingerprint line:", line)
+			continue
+		}
+
+		var rule map[string]string
+		rule = map[string]string{"device_type": fields[1], "os_family": fields[2]}
+		if strings.HasPrefix(fields[0], "vendor:") {
+			rule["vendor_class"] = strings.ToLower(strings.TrimPrefix(fields[0], "vendor:"))
+		} else {
+			var err error
+			rule["fingerprint"], err = NormalizeFingerprint(fields[0])
+			if err != nil {
+				log.Println("bad fingerprint line:", line, err)
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// NormalizeFingerprint checks an option 55 list and drops the blanks, the
+// order is part of the fingerprint and stays
+func NormalizeFingerprint(value string) (string, error) {
+	var options []string
+
+	var item string
+	for _, item = range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var option int
+		var err error
+		option, err = strconv.Atoi(item)
+		if err != nil || option < 1 || option > 254 {
+			return "", errors.New(fmt.Sprintf("invalid dhcp option %q", item))
+		}
+		options = append(options, strconv.Itoa(option))
+	}
+
+	return strings.Join(options, ","), nil
+}
+
+// Classify returns device type and os family, empty when nothing matches
+func Classify(fingerprint string, vendor_class string) (string, string) {
+	var rule map[string]string
+	if fingerprint != "" {
+		for _, rule = range DHCP_FINGERPRINTS {
+			if rule["fingerprint"] == fingerprint {
+				return rule["device_type"], rule["os_family"]
+			}
+		}
+	}
+
+	if vendor_class != "" {
+		vendor_class = strings.ToLower(vendor_class)
+		for _, rule = range DHCP_FINGERPRINTS {
+			if rule["vendor_class"] != "" && strings.HasPrefix(vendor_class, rule["vendor_class"]) {
+				return rule["device_type"], rule["os_family"]
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// SetDhcpFingerprint stores what a client sent and classifies the devices
+// matching where again, a field that is empty keeps what was stored
+func SetDhcpFingerprint(db *sql.DB, where string, args []interface{}, fingerprint string, vendor_class string) int64 {
+	var err error
+
+	var query string
+	query = `SELECT id, dhcp_fingerprint, vendor_class FROM device WHERE ` + where
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, args...)
+	defer rows.Close()
+	Raise(err)
+
+	var devices []map[string]interface{}
+	for rows.Next() {
+		var id int64
+		var fingerprint2 string
+		var vendor_class2 string
+		err = rows.Scan(&id, &fingerprint2, &vendor_class2)
+		Raise(err)
+
+		if fingerprint != "" {
+			fingerprint2 = fingerprint
+		}
+		if vendor_class != "" {
+			vendor_class2 = vendor_class
+		}
+		devices = append(devices, map[string]interface{}{"id": id, "fingerprint": fingerprint2, "vendor_class": vendor_class2})
+	}
+	Raise(rows.Err())
+	rows.Close()
+
+	var device map[string]interface{}
+	for _, device = range devices {
+		var device_type string
+		var os_family string
+		device_type, os_family = Classify(device["fingerprint"].(string), device["vendor_class"].(string))
+
+		_, err = db.Exec(
+			`UPDATE device SET dhcp_fingerprint=?, vendor_class=?, device_type=?, os_family=? WHERE id=?`,
+			device["fingerprint"], device["vendor_class"], device_type, os_family, device["id"],
+		)
+		Raise(err)
+	}
+
+	return int64(len(devices))
+}
+
+var DNSMASQ_LOG_PATTERN = regexp.MustCompile(`dnsmasq-dhcp\[\d+\]: (\d+) (.*)$`)
+
+// ImportDhcpLog reads the per transaction lines dnsmasq writes with
+// --log-dhcp and fingerprints every device whose mac shows up in them
+func ImportDhcpLog(path string) error {
+	var err error
+
+	var file *os.File
+	file, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var macs map[string]string
+	var vendor_classes map[string]string
+	var options map[string][]string
+	macs = make(map[string]string)
+	vendor_classes = make(map[string]string)
+	options = make(map[string][]string)
+
+	// newest transaction per mac wins
+	var found map[string][]string
+	found = make(map[string][]string)
+
+	var scanner *bufio.Scanner
+	scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var match []string
+		match = DNSMASQ_LOG_PATTERN.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+
+		var transaction string
+		var message string
+		transaction = match[1]
+		message = match[2]
+
+		if strings.HasPrefix(message, "available DHCP range") {
+			options[transaction] = nil
+		} else if strings.HasPrefix(message, "vendor class: ") {
+			vendor_classes[transaction] = strings.TrimPrefix(message, "vendor class: ")
+		} else if strings.HasPrefix(message, "DHCPDISCOVER(") || strings.HasPrefix(message, "DHCPREQUEST(") || strings.HasPrefix(message, "DHCPINFORM(") {
+			options[transaction] = nil
+
+			var field string
+			for _, field = range strings.Fields(message)[1:] {
+				var hardware_addr net.HardwareAddr
+				hardware_addr, err = net.ParseMAC(field)
+				if err == nil && len(hardware_addr) == 6 {
+					macs[transaction] = hardware_addr.String()
+				}
+			}
+		} else if strings.HasPrefix(message, "requested options: ") {
+			// long lists are wrapped over several lines, "1:netmask, 3:router,"
+			var item string
+			for _, item = range strings.Split(strings.TrimPrefix(message, "requested options: "), ",") {
+				item = strings.TrimSpace(strings.SplitN(item, ":", 2)[0])
+				if item != "" {
+					options[transaction] = append(options[transaction], item)
+				}
+			}
+
+			if macs[transaction] != "" {
+				found[macs[transaction]] = []string{strings.Join(options[transaction], ","), vendor_classes[transaction]}
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var updated int64
+	var mac string
+	var values []string
+	for mac, values = range found {
+		var fingerprint string
+		fingerprint, err = NormalizeFingerprint(values[0])
+		if err != nil {
+			log.Println("mac:", mac, err)
+			continue
+		}
+
+		var count int64
+		count = SetDhcpFingerprint(db, "LOWER(mac)=?", []interface{}{mac}, fingerprint, values[1])
+		if count == 0 {
+			log.Println("mac:", mac, "not seen by any agent yet")
+		}
+		updated += count
+	}
+
+	log.Println("macs in log:", len(found), "devices updated:", updated)
+	return nil
+}
+
+func Columns(from int, to int) []string {
+	var columns []string
+	var i int
+	for i = from; i <= to; i++ {
+		columns = append(columns, fmt.Sprintf("%02d", i))
+	}
+	return columns
+}
+
+// BUCKETS describes the Distribution grid for each bucket size, one row per
+// hour, day, month or year and one column per bucket inside it
+var BUCKETS = map[string]map[string]interface{}{
+	"minute": {"columns": Columns(0, 59), "scale": 1, "max": 2 * 24 * time.Hour},
+	"hour":   {"columns": Columns(0, 23), "scale": 60, "max": 62 * 24 * time.Hour},
+	"day":    {"columns": Columns(1, 31), "scale": 1440, "max": 2 * 366 * 24 * time.Hour},
+	"week":   {"columns": Columns(1, 53), "scale": 10080, "max": 5 * 366 * 24 * time.Hour},
+}
+
+func BucketKey(bucket string, input time.Time) (string, string) {
+	if bucket == "minute" {
+		return input.Format("2006-01-02 15h"), input.Format("04")
+	} else if bucket == "day" {
+		return input.Format("2006-01"), input.Format("02")
+	} else if bucket == "week" {
+		var year int
+		var week int
+		year, week = input.ISOWeek()
+		return fmt.Sprintf("%d", year), fmt.Sprintf("%02d", week)
+	}
+	return input.Format("20060102"), input.Format("15")
+}
+
+func BucketDefaultFrom(bucket string, now time.Time) time.Time {
+	if bucket == "minute" {
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour()-5, 0, 0, 0, now.Location())
+	} else if bucket == "day" {
+		return time.Date(now.Year(), now.Month()-11, 1, 0, 0, 0, 0, now.Location())
+	} else if bucket == "week" {
+		return time.Date(now.Year()-1, 1, 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()-30, 0, 0, 0, 0, now.Location())
+}
+
+// ranges are half open, to itself is excluded
+func BucketDefaultTo(bucket string, now time.Time) time.Time {
+	if bucket == "minute" {
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+// BucketRows lists the row keys covering [from, to), newest first
+func BucketRows(bucket string, from time.Time, to time.Time) []string {
+	var rows []string
+	rows = make([]string, 0)
+
+	var seen map[string]bool
+	seen = make(map[string]bool)
+
+	var current time.Time
+	for current = from; current.Before(to); {
+		var row string
+		row, _ = BucketKey(bucket, current)
+		if !seen[row] {
+			seen[row] = true
+			rows = append([]string{row}, rows...)
+		}
+
+		if bucket == "minute" {
+			current = current.Add(1 * time.Minute)
+		} else if bucket == "hour" {
+			current = current.Add(1 * time.Hour)
+		} else {
+			current = current.AddDate(0, 0, 1)
+		}
+	}
+
+	var last string
+	last, _ = BucketKey(bucket, to.Add(-time.Second))
+	if !seen[last] {
+		rows = append([]string{last}, rows...)
+	}
+
+	return rows
+}
+
+func ParseTz(values url.Values) (*time.Location, error) {
+	var err error
+
+	if values.Get("tz") == "" {
+		return time.Local, nil
+	}
+
+	var loc *time.Location
+	loc, err = time.LoadLocation(values.Get("tz"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid tz %q", values.Get("tz")))
+	}
+	return loc, nil
+}
+
+// ParseRange reads from and to in loc and rejects ranges longer than max
+func ParseRange(values url.Values, loc *time.Location, default_from time.Time, default_to time.Time, max time.Duration) (time.Time, time.Time, error) {
+	var err error
+
+	var from time.Time
+	var to time.Time
+	from = default_from
+	to = default_to
+
+	if values.Get("from") != "" {
+		from, err = ParseTimeParam(values.Get("from"), loc)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if values.Get("to") != "" {
+		to, err = ParseTimeParam(values.Get("to"), loc)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	if to.Sub(from) > max {
+		return from, to, errors.New(fmt.Sprintf("range must not be longer than %v", max))
+	}
+
+	return from.In(loc), to.In(loc), nil
+}
+
+// RangeData feeds the range picker, prev and next keep every other parameter
+// and move the window by its own length
+func RangeData(values url.Values, path string, from time.Time, to time.Time, loc *time.Location) map[string]interface{} {
+	var span time.Duration
+	span = to.Sub(from)
+
+	var link = func(from2 time.Time, to2 time.Time) string {
+		var values2 url.Values
+		values2 = url.Values{}
+
+		var key string
+		for key = range values {
+			values2.Set(key, values.Get(key))
+		}
+		values2.Set("from", from2.In(loc).Format("2006-01-02T15:04:05"))
+		values2.Set("to", to2.In(loc).Format("2006-01-02T15:04:05"))
+		return path + "?" + values2.Encode()
+	}
+
+	var export url.Values
+	export = url.Values{}
+	export.Set("from", FormatApiTime(from))
+	export.Set("to", FormatApiTime(to))
+	if values.Get("ip") != "" {
+		export.Set("ip", values.Get("ip"))
+	}
+	if values.Get("agent") != "" {
+		export.Set("agent", values.Get("agent"))
+	}
+
+	return map[string]interface{}{
+		"from":   from.Format("2006-01-02T15:04"),
+		"to":     to.Format("2006-01-02T15:04"),
+		"tz":     loc.String(),
+		"prev":   link(from.Add(-span), from),
+		"next":   link(to, to.Add(span)),
+		"ip":     values.Get("ip"),
+		"agent":  values.Get("agent"),
+		"group":  values.Get("group"),
+		"export": "/export/logs?" + export.Encode(),
+	}
+}
+
+func Distribution(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var ip string
+	ip = values.Get("ip")
+	ip = strings.TrimSpace(ip)
+	log.Println("ip:", ip)
+
+	var agent_id string
+	agent_id = values.Get("agent")
+	agent_id = strings.TrimSpace(agent_id)
+	log.Println("agent_id:", agent_id)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var loc *time.Location
+	loc, err = ParseTz(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var bucket string
+	bucket = values.Get("bucket")
+	if bucket == "" {
+		bucket = "hour"
+	}
+	var ok bool
+	_, ok = BUCKETS[bucket]
+	if !ok {
+		ApiError(response, 400, "bucket must be one of minute, hour, day, week")
+		return
+	}
+	log.Println("bucket:", bucket)
+
+	var now time.Time
+	now = time.Now().In(loc)
+
+	var from time.Time
+	var to time.Time
+	from, to, err = ParseRange(values, loc, BucketDefaultFrom(bucket, now), BucketDefaultTo(bucket, now), BUCKETS[bucket]["max"].(time.Duration))
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var begin_time string
+	begin_time = DbTime(from)
+	log.Println("begin_time:", begin_time)
+
+	var end_time string
+	end_time = DbTime(to)
+	log.Println("end_time:", end_time)
+
+	var dates []string
+	dates = BucketRows(bucket, from, to)
+	log.Println("dates:", dates)
+
+	// a group limits the heatmap to the devices it has now
+	var members map[string]bool
+	if values.Get("group") != "" {
+		var group *DeviceGroup
+		group, err = LoadDeviceGroup(db, values.Get("group"))
+		if err == sql.ErrNoRows {
+			ApiError(response, 404, "no such group")
+			return
+		}
+		Raise(err)
+
+		members = make(map[string]bool)
+
+		var device map[string]interface{}
+		for _, device = range LoadGroupDevices(db) {
+			if group.Matches(device) {
+				members[device["agent_id"].(string)+"|"+device["ip"].(string)] = true
+			}
+		}
+		log.Println("members:", len(members))
+	}
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"heartbeat_time>=?", "heartbeat_time<?"}
+	args = []interface{}{begin_time, end_time}
+	if ip != "" {
+		conditions = append(conditions, "ip=?")
+		args = append(args, ip)
+	}
+	if agent_id != "" {
+		conditions = append(conditions, "agent_id=?")
+		args = append(args, agent_id)
+	}
+
+	var query string
+	query = `
+		SELECT id, agent_id, ip, name, heartbeat_time
+		FROM device_log
+		WHERE %s
+	`
+	query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, args...)
+	defer rows.Close()
+	Raise(err)
+
+	var device_logs map[string]map[string]int
+	device_logs = make(map[string]map[string]int)
+
+	for rows.Next() {
+		var id int64
+		var agent_id string
+		var ip string
+		var name string
+		var heartbeat_time time.Time
+
+		err = rows.Scan(&id, &agent_id, &ip, &name, &heartbeat_time)
+		Raise(err)
+
+		if members != nil && !members[agent_id+"|"+ip] {
+			continue
+		}
+
+		var year_month_day string
+		var hour string
+		year_month_day, hour = BucketKey(bucket, heartbeat_time.In(loc))
+
+		var ok bool
+		_, ok = device_logs[year_month_day]
+		if ok {
+			var ok2 bool
+			_, ok2 = device_logs[year_month_day][hour]
+			if ok2 {
+				device_logs[year_month_day][hour] += 1
+			} else {
+				device_logs[year_month_day][hour] = 1
+			}
+		} else {
+			device_logs[year_month_day] = map[string]int{hour: 1}
+		}
+	}
+	log.Println("device_logs:", device_logs)
+
+	var hours []string
+	hours = BUCKETS[bucket]["columns"].([]string)
+
+	// shade cells relative to a full bucket of one heartbeat per minute
+	var scale int
+	scale = BUCKETS[bucket]["scale"].(int)
+	if len(members) > 1 {
+		scale *= len(members)
+	}
+
+	var data struct {
+		User       map[string]interface{}    `json:"-"`
+		Range      map[string]interface{}    `json:"range"`
+		Bucket     string                    `json:"bucket"`
+		Buckets    []string                  `json:"-"`
+		Level2     int                       `json:"-"`
+		Level3     int                       `json:"-"`
+		Dates      []string                  `json:"dates"`
+		Hours      []string                  `json:"hours"`
+		Rows       []string                  `json:"rows"`
+		Columns    []string                  `json:"columns"`
+		DeviceLogs map[string]map[string]int `json:"device_logs"`
+	}
+	data.User = CurrentUser(request)
+	data.Range = RangeData(values, request.URL.Path, from, to, loc)
+	data.Bucket = bucket
+	data.Buckets = []string{"minute", "hour", "day", "week"}
+	data.Level2 = (scale + 2) / 3
+	data.Level3 = (scale*2 + 2) / 3
+	// dates and hours are what consumers read before buckets existed, for the
+	// default hour bucket they are exactly that, rows and columns name the grid
+	// of any bucket
+	data.Dates = dates
+	data.Hours = hours
+	data.Rows = dates
+	data.Columns = hours
+	data.DeviceLogs = device_logs
+	log.Println("data:", data)
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/distribution.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/distribution.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+var SOURCE_PATTERN = regexp.MustCompile(`^[a-z0-9_-]{0,32}$`)
+
+// a spool file the agent would replay forever gets a 413 and is dropped
+const REPORT_MAX_BYTES = 32 << 20
+
+func Report(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	// everything that returns before the database is opened is a rejection
+	var result string
+	result = "rejected"
+	defer func() {
+		AddMetric("lnx801_reports_total", map[string]string{"result": result}, 1)
+	}()
+
+	var body []byte
+	body, err = ioutil.ReadAll(http.MaxBytesReader(response, request.Body, REPORT_MAX_BYTES))
+	if err != nil {
+		var max_bytes_error *http.MaxBytesError
+		if errors.As(err, &max_bytes_error) {
+			log.Println("report too large:", request.ContentLength)
+			Api(response, 413)
+			return
+		}
+		Raise(err)
+	}
+	log.Println("body:", len(body), "bytes")
+
+	var data []map[string]interface{}
+	json.Unmarshal(body, &data)
+
+	log.Println("devices:", len(data))
+
+	if len(data) == 0 {
+		Api(response, 400)
+		return
+	}
+
+	// validate the whole batch first, a spooled report that can never be
+	// accepted must get a 4xx so the agent drops it instead of retrying
+	var device map[string]interface{}
+	for _, device = range data {
+		var field string
+		for _, field = range []string{"ip", "mac", "name", "heartbeat_time"} {
+			var ok bool
+			_, ok = device[field].(string)
+			if !ok {
+				log.Println("invalid field:", field, device)
+				Api(response, 400)
+				return
+			}
+		}
+
+		var heartbeat_time time.Time
+		heartbeat_time, err = ParseHeartbeatTime(device["heartbeat_time"].(string))
+		if err != nil {
+			log.Println(err)
+			Api(response, 400)
+			return
+		}
+		device["heartbeat_time"] = DbTime(heartbeat_time)
+
+		// agents older than the registration protocol do not send agent_id
+		var ok bool
+		var agent_id string
+		agent_id, ok = device["agent_id"].(string)
+		if !ok && device["agent_id"] != nil {
+			log.Println("invalid field:", "agent_id", device)
+			Api(response, 400)
+			return
+		}
+
+		if !TokenAllowsAgent(request, agent_id) {
+			log.Println("token not allowed for agent:", agent_id)
+			Api(response, 403)
+			return
+		}
+
+		// agents that sniff DHCP add what the client asked for, a bad
+		// fingerprint is dropped rather than the heartbeat
+		for _, field = range []string{"dhcp_fingerprint", "vendor_class"} {
+			_, ok = device[field].(string)
+			if !ok && device[field] != nil {
+				log.Println("invalid field:", field, device)
+				Api(response, 400)
+				return
+			}
+		}
+		if device["dhcp_fingerprint"] != nil {
+			device["dhcp_fingerprint"], err = NormalizeFingerprint(device["dhcp_fingerprint"].(string))
+			Skip(err)
+		}
+
+		// what found the device, ping, what the passive listener heard or a
+		// router or lease file; older agents send nothing
+		if device["source"] == nil {
+			device["source"] = ""
+		}
+		var source string
+		source, ok = device["source"].(string)
+		if !ok || !SOURCE_PATTERN.MatchString(source) {
+			log.Println("invalid field:", "source", device)
+			Api(response, 400)
+			return
+		}
+
+		if device["ping"] != nil {
+			device["ping"], err = ParseReportPing(device["ping"])
+			if err != nil {
+				log.Println("invalid field:", "ping", err)
+				Api(response, 400)
+				return
+			}
+		}
+
+		if device["snmp"] != nil {
+			device["snmp"], err = ParseReportSnmp(device["snmp"])
+			if err != nil {
+				log.Println("invalid field:", "snmp", err)
+				Api(response, 400)
+				return
+			}
+		}
+
+		// only heartbeats that finish a port scan carry ports
+		if device["ports"] != nil {
+			device["ports"], err = ParseReportPorts(device["ports"])
+			if err != nil {
+				log.Println("invalid field:", "ports", err)
+				Api(response, 400)
+				return
+			}
+		}
+	}
+
+	result = "error"
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var agent_ids map[string]string
+	agent_ids = make(map[string]string)
+
+	for _, device = range data {
+		log.Println("device:", device)
+
+		var agent_id string
+		var ip string
+		var mac string
+		var name string
+		var heartbeat_time string
+		var source string
+
+		agent_id, _ = device["agent_id"].(string)
+		ip = device["ip"].(string)
+		mac = device["mac"].(string)
+		name = device["name"].(string)
+		heartbeat_time = device["heartbeat_time"].(string)
+		source = device["source"].(string)
+
+		// if ip != "192.168.18.107" {
+		// 	continue
+		// }
+
+		// a ping without any reply counts towards the loss of a device the
+		// agent saw before, but is no heartbeat
+		if device["ping"] != nil && device["ping"].(map[string]interface{})["received"] == 0.0 {
+			var result sql.Result
+			result, err = db.Exec(`INSERT OR IGNORE INTO ping_loss (agent_id, ip, probe_time, sent) VALUES (?,?,?,?)`, agent_id, ip, heartbeat_time, device["ping"].(map[string]interface{})["sent"])
+			Raise(err)
+
+			var rows_affected int64
+			rows_affected, err = result.RowsAffected()
+			Raise(err)
+
+			var heartbeat_time2 string
+			err = db.QueryRow(`SELECT CAST(heartbeat_time AS TEXT) FROM device WHERE agent_id=? AND ip=?`, agent_id, ip).Scan(&heartbeat_time2)
+			if err != sql.ErrNoRows {
+				Raise(err)
+				// a replayed old ping says nothing about the device now
+				if rows_affected == 1 && heartbeat_time2 <= heartbeat_time {
+					CheckPing(db, agent_id, ip, mac, name, heartbeat_time)
+				}
+			}
+
+			if heartbeat_time > agent_ids[agent_id] {
+				agent_ids[agent_id] = heartbeat_time
+			}
+			continue
+		}
+
+		// replayed reports keep their original heartbeat_time, and the same
+		// report may arrive twice when the agent never saw our response
+		var duplicated int64
+		{
+			var query string
+			query = `SELECT COUNT(*) FROM device_log WHERE agent_id=? AND ip=? AND heartbeat_time=?`
+			err = db.QueryRow(query, agent_id, ip, heartbeat_time).Scan(&duplicated)
+			Raise(err)
+		}
+		{
+			if duplicated == 0 {
+				// heartbeats that are not pings have no round trip, NULL
+				var rtts []interface{}
+				rtts = make([]interface{}, 5)
+				if device["ping"] != nil {
+					var ping map[string]interface{}
+					ping = device["ping"].(map[string]interface{})
+					rtts = []interface{}{ping["rtt_min"], ping["rtt_avg"], ping["rtt_max"], ping["jitter"], ping["loss"]}
+				}
+
+				var query string
+				query = `INSERT INTO device_log (agent_id, ip, mac, name, heartbeat_time, source, rtt_min, rtt_avg, rtt_max, jitter, loss) VALUES (?,?,?,?,?,?,?,?,?,?,?)`
+				_, err = db.Exec(query, append([]interface{}{agent_id, ip, mac, name, heartbeat_time, source}, rtts...)...)
+				Raise(err)
+
+				AddMetric("lnx801_report_heartbeats_total", map[string]string{"agent_id": agent_id}, 1)
+
+				PublishDevice("heartbeat", agent_id, ip, mac, name, heartbeat_time, nil)
+			} else {
+				AddMetric("lnx801_report_duplicates_total", nil, 1)
+			}
+		}
+
+		// subnets of different agents may overlap, so a device is agent_id+ip
+		var existed bool
+		var online int64
+		{
+			var query string
+			query = `SELECT online FROM device WHERE agent_id=? AND ip=?`
+			err = db.QueryRow(query, agent_id, ip).Scan(&online)
+			if err == sql.ErrNoRows {
+				existed = false
+			} else {
+				Raise(err)
+				existed = true
+			}
+		}
+		{
+			if !existed {
+				var query string
+				query = `INSERT INTO device (agent_id, ip, mac, name, heartbeat_time, online, source) VALUES (?,?,?,?,?,1,?)`
+				_, err = db.Exec(query, agent_id, ip, mac, name, heartbeat_time, source)
+				Raise(err)
+
+				AddEvent(db, "new", agent_id, ip, mac, name, "first seen", heartbeat_time)
+			} else {
+				// never move heartbeat_time backwards when old reports are replayed
+				var query string
+				query = `UPDATE device set mac=?, name=?, heartbeat_time=?, source=? WHERE agent_id=? AND ip=? AND heartbeat_time<=?`
+
+				var result sql.Result
+				result, err = db.Exec(query, mac, name, heartbeat_time, source, agent_id, ip, heartbeat_time)
+				Raise(err)
+
+				var rows_affected int64
+				rows_affected, err = result.RowsAffected()
+				log.Println("rows_affected:", rows_affected)
+				Raise(err)
+
+				// a replayed heartbeat from long ago does not bring a device back
+				var heartbeat_time2 time.Time
+				heartbeat_time2, err = time.ParseInLocation("2006-01-02 15:04:05", heartbeat_time, time.UTC)
+				Raise(err)
+
+				if rows_affected == 1 && online == 0 && time.Since(heartbeat_time2) <= OFFLINE_AFTER {
+					_, err = db.Exec(`UPDATE device SET online=1 WHERE agent_id=? AND ip=?`, agent_id, ip)
+					Raise(err)
+
+					AddEvent(db, "online", agent_id, ip, mac, name, "heartbeat received", heartbeat_time)
+				}
+			}
+		}
+
+		{
+			var fingerprint string
+			var vendor_class string
+			fingerprint, _ = device["dhcp_fingerprint"].(string)
+			vendor_class, _ = device["vendor_class"].(string)
+			if fingerprint != "" || vendor_class != "" {
+				SetDhcpFingerprint(db, "agent_id=? AND ip=?", []interface{}{agent_id, ip}, fingerprint, vendor_class)
+			}
+		}
+
+		// a replayed old heartbeat says nothing about the device now
+		if device["ping"] != nil && duplicated == 0 {
+			var heartbeat_time2 string
+			err = db.QueryRow(`SELECT CAST(heartbeat_time AS TEXT) FROM device WHERE agent_id=? AND ip=?`, agent_id, ip).Scan(&heartbeat_time2)
+			Raise(err)
+			if heartbeat_time2 == heartbeat_time {
+				CheckPing(db, agent_id, ip, mac, name, heartbeat_time)
+			}
+		}
+
+		if (device["ports"] != nil || device["snmp"] != nil) && duplicated == 0 {
+			var id int64
+			err = db.QueryRow(`SELECT id FROM device WHERE agent_id=? AND ip=?`, agent_id, ip).Scan(&id)
+			Raise(err)
+
+			if device["ports"] != nil {
+				SyncOpenPorts(db, map[string]interface{}{"id": id, "agent_id": agent_id, "ip": ip, "mac": mac, "name": name}, device["ports"].([]map[string]interface{}), heartbeat_time)
+			}
+			if device["snmp"] != nil {
+				SyncSnmp(db, id, device["snmp"].(map[string]interface{}), heartbeat_time)
+			}
+		}
+
+		if heartbeat_time > agent_ids[agent_id] {
+			agent_ids[agent_id] = heartbeat_time
+		}
+	}
+
+	{
+		var agent_id string
+		var report_time string
+		for agent_id, report_time = range agent_ids {
+			if agent_id == "" {
+				continue
+			}
+
+			var query string
+			query = `
+				INSERT INTO agent (agent_id, hostname, version, cidrs, register_time, report_time)
+				VALUES (?,'','','',?,?)
+				ON CONFLICT (agent_id) DO UPDATE SET report_time=excluded.report_time
+				WHERE agent.report_time IS NULL OR excluded.report_time>agent.report_time
+			`
+			_, err = db.Exec(query, agent_id, report_time, report_time)
+			Raise(err)
+		}
+	}
+
+	// agents have no endpoint of their own, what they should do rides on the
+	// response to their reports
+	var commands []map[string]interface{}
+	commands = make([]map[string]interface{}, 0)
+	{
+		var agent_id string
+		for agent_id = range agent_ids {
+			if agent_id != "" {
+				AckWakes(db, agent_id, request.URL.Query().Get("wakes"))
+				commands = append(commands, RelayWakes(db, agent_id)...)
+			}
+		}
+	}
+
+	result = "accepted"
+	if len(commands) > 0 {
+		Api(response, 200, map[string]interface{}{"commands": commands})
+	} else {
+		Api(response, 200)
+	}
+}
+
+// Availability follows the heartbeats of one device through one window. A
+// device counts as up for one scan interval after each heartbeat, a gap of
+// more than two intervals is an outage from the missed scan to the next
+// heartbeat.
+type Availability struct {
+	Start         time.Time
+	End           time.Time
+	ObservedStart time.Time
+	Prev          time.Time
+	HasPrev       bool
+	Downtime      time.Duration
+	Longest       time.Duration
+	Outages       int
+	Ongoing       bool
+}
+
+func (window *Availability) AddOutage(outage_start time.Time, outage_end time.Time) {
+	if outage_start.Before(window.Start) {
+		outage_start = window.Start
+	}
+	if outage_end.After(window.End) {
+		outage_end = window.End
+	}
+	if !outage_end.After(outage_start) {
+		return
+	}
+
+	var outage time.Duration
+	outage = outage_end.Sub(outage_start)
+
+	window.Downtime += outage
+	window.Outages += 1
+	if outage > window.Longest {
+		window.Longest = outage
+	}
+}
+
+func (window *Availability) Observe(heartbeat_time time.Time, interval time.Duration) {
+	if heartbeat_time.After(window.End) {
+		return
+	}
+
+	if !window.HasPrev {
+		// a device first seen inside the window is judged from then on
+		window.ObservedStart = window.Start
+		if heartbeat_time.After(window.Start) {
+			window.ObservedStart = heartbeat_time
+		}
+	} else if heartbeat_time.Sub(window.Prev) > 2*interval {
+		window.AddOutage(window.Prev.Add(interval), heartbeat_time)
+	}
+
+	window.Prev = heartbeat_time
+	window.HasPrev = true
+}
+
+func (window *Availability) Finish(interval time.Duration) {
+	if window.HasPrev && window.End.Sub(window.Prev) > 2*interval {
+		window.AddOutage(window.Prev.Add(interval), window.End)
+		window.Ongoing = true
+	}
+}
+
+func (window *Availability) Result() map[string]interface{} {
+	if !window.HasPrev || !window.ObservedStart.Before(window.End) {
+		return map[string]interface{}{"availability": nil}
+	}
+
+	var observed time.Duration
+	var uptime time.Duration
+	observed = window.End.Sub(window.ObservedStart)
+	uptime = observed - window.Downtime
+
+	var result map[string]interface{}
+	result = map[string]interface{}{
+		"availability":   float64(int64(uptime.Seconds()/observed.Seconds()*100000)) / 1000,
+		"observed":       int64(observed.Seconds()),
+		"downtime":       int64(window.Downtime.Seconds()),
+		"outages":        window.Outages,
+		"longest_outage": int64(window.Longest.Seconds()),
+		"ongoing":        window.Ongoing,
+		"mtbf":           nil,
+		"mttr":           nil,
+	}
+	if window.Outages > 0 {
+		result["mtbf"] = int64(uptime.Seconds()) / int64(window.Outages)
+		result["mttr"] = int64(window.Downtime.Seconds()) / int64(window.Outages)
+	}
+	return result
+}
+
+func FormatSeconds(value interface{}) string {
+	var seconds int64
+	var ok bool
+	seconds, ok = value.(int64)
+	if !ok {
+		return "-"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+var AVAILABILITY_PERIODS = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+}
+
+func Availabilities(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var period string
+	period = values.Get("period")
+	if period == "" {
+		period = "day"
+	}
+	var ok bool
+	_, ok = AVAILABILITY_PERIODS[period]
+	if !ok {
+		ApiError(response, 400, "period must be one of day, week, month")
+		return
+	}
+
+	var agent_id string
+	agent_id = strings.TrimSpace(values.Get("agent"))
+
+	var ip string
+	ip = strings.TrimSpace(values.Get("ip"))
+
+	var interval time.Duration
+	interval = SETTINGS.SCAN_INTERVAL
+
+	var now time.Time
+	now = time.Now()
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"1=1"}
+	if agent_id != "" {
+		conditions = append(conditions, "agent_id=?")
+		args = append(args, agent_id)
+	}
+	if ip != "" {
+		conditions = append(conditions, "ip=?")
+		args = append(args, ip)
+	}
+
+	var devices []map[string]interface{}
+	var windows map[string]map[string]*Availability
+	devices = make([]map[string]interface{}, 0)
+	windows = make(map[string]map[string]*Availability)
+	{
+		var query string
+		query = `SELECT agent_id, ip, mac, name FROM device WHERE %s ORDER BY agent_id, ip`
+		query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, args...)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var agent_id string
+			var ip string
+			var mac string
+			var name string
+
+			err = rows.Scan(&agent_id, &ip, &mac, &name)
+			Raise(err)
+
+			devices = append(devices, map[string]interface{}{"agent_id": agent_id, "ip": ip, "mac": mac, "name": name})
+
+			windows[agent_id+"|"+ip] = make(map[string]*Availability)
+
+			var key string
+			var duration time.Duration
+			for key, duration = range AVAILABILITY_PERIODS {
+				windows[agent_id+"|"+ip][key] = &Availability{Start: now.Add(-duration), End: now}
+			}
+		}
+		Raise(rows.Err())
+	}
+
+	// the last heartbeat before the month tells whether a device was already
+	// down when the windows begin, the rest are streamed in order
+	var month_start string
+	month_start = DbTime(now.Add(-AVAILABILITY_PERIODS["month"]))
+
+	var args2 []interface{}
+	args2 = append(args2, month_start)
+	args2 = append(args2, args...)
+	{
+		var query string
+		query = `SELECT agent_id, ip, MAX(heartbeat_time) FROM device_log WHERE heartbeat_time<? AND %s GROUP BY agent_id, ip`
+		query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, args2...)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var agent_id string
+			var ip string
+			var heartbeat_time string
+
+			err = rows.Scan(&agent_id, &ip, &heartbeat_time)
+			Raise(err)
+
+			var heartbeat_time2 time.Time
+			heartbeat_time2, err = time.ParseInLocation("2006-01-02 15:04:05", heartbeat_time, time.UTC)
+			if err != nil {
+				Skip(err)
+				continue
+			}
+
+			var window *Availability
+			for _, window = range windows[agent_id+"|"+ip] {
+				window.Observe(heartbeat_time2, interval)
+			}
+		}
+		Raise(rows.Err())
+	}
+	{
+		var query string
+		query = `SELECT agent_id, ip, heartbeat_time FROM device_log WHERE heartbeat_time>=? AND %s ORDER BY heartbeat_time`
+		query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, args2...)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var agent_id string
+			var ip string
+			var heartbeat_time time.Time
+
+			err = rows.Scan(&agent_id, &ip, &heartbeat_time)
+			Raise(err)
+
+			var window *Availability
+			for _, window = range windows[agent_id+"|"+ip] {
+				window.Observe(heartbeat_time, interval)
+			}
+		}
+		Raise(rows.Err())
+	}
+
+	var device map[string]interface{}
+	for _, device = range devices {
+		var key string
+		var window *Availability
+		for key, window = range windows[device["agent_id"].(string)+"|"+device["ip"].(string)] {
+			window.Finish(interval)
+			device[key] = window.Result()
+		}
+	}
+
+	if strings.HasSuffix(request.URL.Path, ".csv") {
+		response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="availability-%s-%s.csv"`, period, now.Format("20060102")))
+
+		var writer *csv.Writer
+		writer = csv.NewWriter(response)
+		writer.Write([]string{
+			"agent_id", "ip", "mac", "name",
+			"day_availability", "week_availability", "month_availability",
+			"period", "outages", "downtime_seconds", "longest_outage_seconds", "mtbf_seconds", "mttr_seconds",
+		})
+		for _, device = range devices {
+			var result map[string]interface{}
+			result = device[period].(map[string]interface{})
+
+			var cell = func(value interface{}) string {
+				if value == nil {
+					return ""
+				}
+				return fmt.Sprint(value)
+			}
+
+			writer.Write([]string{
+				device["agent_id"].(string), device["ip"].(string), device["mac"].(string), device["name"].(string),
+				cell(device["day"].(map[string]interface{})["availability"]),
+				cell(device["week"].(map[string]interface{})["availability"]),
+				cell(device["month"].(map[string]interface{})["availability"]),
+				period, cell(result["outages"]), cell(result["downtime"]), cell(result["longest_outage"]), cell(result["mtbf"]), cell(result["mttr"]),
+			})
+		}
+		writer.Flush()
+		Skip(writer.Error())
+		return
+	}
+
+	var data struct {
+		User     map[string]interface{}   `json:"-"`
+		Period   string                   `json:"period"`
+		Periods  []string                 `json:"-"`
+		Interval string                   `json:"interval"`
+		Devices  []map[string]interface{} `json:"devices"`
+	}
+	data.User = CurrentUser(request)
+	data.Period = period
+	data.Periods = []string{"day", "week", "month"}
+	data.Interval = interval.String()
+	data.Devices = devices
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.New("report.html").Funcs(template.FuncMap{"duration": FormatSeconds}).ParseFiles("template/report.html")
+		} else {
+			tpl, err = template.New("report.html").Funcs(template.FuncMap{"duration": FormatSeconds}).ParseFS(TEMPLATE, "template/report.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+// Exporter writes rows as csv, ndjson or xlsx straight to the response. An
+// xlsx file is a zip of xml parts, the sheet is one zip entry written row by
+// row with inline strings so nothing has to be kept until the end.
+type Exporter struct {
+	Format  string
+	Sheet   string
+	Columns []string
+	Writer  io.Writer
+	Csv     *csv.Writer
+	Zip     *zip.Writer
+	Rows    int
+}
+
+var EXPORT_FORMATS = map[string]map[string]string{
+	"csv":    {"content_type": "text/csv; charset=utf-8", "ext": "csv"},
+	"ndjson": {"content_type": "application/x-ndjson", "ext": "ndjson"},
+	"xlsx":   {"content_type": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "ext": "xlsx"},
+}
+
+// the last row a sheet can hold, the header takes one
+const XLSX_MAX_ROWS = 1048576
+
+var XLSX_PARTS = []map[string]string{
+	{
+		"name": "[Content_Types].xml",
+		"body": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`</Types>`,
+	},
+	{
+		"name": "_rels/.rels",
+		"body": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`,
+	},
+	{
+		"name": "xl/_rels/workbook.xml.rels",
+		"body": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`</Relationships>`,
+	},
+	{
+		"name": "xl/workbook.xml",
+		"body": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>` +
+			`</workbook>`,
+	},
+}
+
+func (exporter *Exporter) Begin() error {
+	var err error
+
+	if exporter.Format == "csv" {
+		exporter.Csv = csv.NewWriter(exporter.Writer)
+		return exporter.Csv.Write(exporter.Columns)
+	}
+
+	if exporter.Format == "xlsx" {
+		exporter.Zip = zip.NewWriter(exporter.Writer)
+
+		var part map[string]string
+		for _, part = range XLSX_PARTS {
+			var writer io.Writer
+			writer, err = exporter.Zip.Create(part["name"])
+			if err != nil {
+				return err
+			}
+
+			var body string
+			body = part["body"]
+			if part["name"] == "xl/workbook.xml" {
+				body = fmt.Sprintf(body, exporter.Sheet)
+			}
+			_, err = io.WriteString(writer, body)
+			if err != nil {
+				return err
+			}
+		}
+
+		exporter.Writer, err = exporter.Zip.Create("xl/worksheets/sheet1.xml")
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(exporter.Writer, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+
+			`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+		if err != nil {
+			return err
+		}
+
+		var values []interface{}
+		var column string
+		for _, column = range exporter.Columns {
+			values = append(values, column)
+		}
+		return exporter.XlsxRow(values)
+	}
+
+	return nil
+}
+
+func (exporter *Exporter) XlsxRow(values []interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString("<row>")
+
+	var value interface{}
+	for _, value = range values {
+		switch value.(type) {
+		case int, int64, float64:
+			fmt.Fprintf(&buf, "<c><v>%v</v></c>", value)
+		default:
+			buf.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(&buf, []byte(fmt.Sprint(value)))
+			buf.WriteString("</t></is></c>")
+		}
+	}
+
+	buf.WriteString("</row>")
+
+	var err error
+	_, err = exporter.Writer.Write(buf.Bytes())
+	return err
+}
+
+func (exporter *Exporter) Row(values []interface{}) error {
+	var err error
+
+	exporter.Rows += 1
+
+	if exporter.Format == "csv" {
+		var record []string
+		var value interface{}
+		for _, value = range values {
+			record = append(record, fmt.Sprint(value))
+		}
+		return exporter.Csv.Write(record)
+	}
+
+	if exporter.Format == "ndjson" {
+		var item map[string]interface{}
+		item = make(map[string]interface{})
+
+		var index int
+		var column string
+		for index, column = range exporter.Columns {
+			item[column] = values[index]
+		}
+
+		var body []byte
+		body, err = json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		_, err = exporter.Writer.Write(append(body, '\n'))
+		return err
+	}
+
+	if exporter.Rows >= XLSX_MAX_ROWS {
+		if exporter.Rows == XLSX_MAX_ROWS {
+			log.Println("xlsx sheet is full, dropping the remaining rows")
+		}
+		return nil
+	}
+	return exporter.XlsxRow(values)
+}
+
+func (exporter *Exporter) Flush() error {
+	if exporter.Csv != nil {
+		exporter.Csv.Flush()
+		return exporter.Csv.Error()
+	}
+	return nil
+}
+
+func (exporter *Exporter) End() error {
+	var err error
+
+	if exporter.Format == "csv" {
+		return exporter.Flush()
+	}
+
+	if exporter.Format == "xlsx" {
+		_, err = io.WriteString(exporter.Writer, "</sheetData></worksheet>")
+		if err != nil {
+			return err
+		}
+		return exporter.Zip.Close()
+	}
+
+	return nil
+}
+
+const EXPORT_CHUNK = 1000
+
+// Export streams devices or device_log rows. Rows are read in chunks by
+// (heartbeat_time, id) and every chunk is written out before the next query,
+// so a slow client neither holds the whole range in memory nor keeps the
+// database locked against reports.
+func Export(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var kind string
+	kind = path.Base(request.URL.Path)
+
+	var table string
+	var columns []string
+	if kind == "devices" {
+		table = "device"
+		columns = []string{"id", "agent_id", "ip", "mac", "name", "heartbeat_time", "online"}
+	} else if kind == "logs" {
+		table = "device_log"
+		columns = []string{"id", "agent_id", "ip", "mac", "name", "heartbeat_time", "source"}
+	} else {
+		ApiError(response, 404, "no such export")
+		return
+	}
+
+	var format string
+	format = values.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	var ok bool
+	_, ok = EXPORT_FORMATS[format]
+	if !ok {
+		ApiError(response, 400, "format must be one of csv, ndjson, xlsx")
+		return
+	}
+
+	var loc *time.Location
+	loc, err = ParseTz(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"1=1"}
+	if values.Get("agent") != "" {
+		conditions = append(conditions, "agent_id=?")
+		args = append(args, values.Get("agent"))
+	}
+	if values.Get("ip") != "" {
+		conditions = append(conditions, "ip=?")
+		args = append(args, values.Get("ip"))
+	}
+	if values.Get("mac") != "" {
+		conditions = append(conditions, "LOWER(mac)=LOWER(?)")
+		args = append(args, values.Get("mac"))
+	}
+	if values.Get("from") != "" {
+		var from time.Time
+		from, err = ParseTimeParam(values.Get("from"), loc)
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+		conditions = append(conditions, "heartbeat_time>=?")
+		args = append(args, DbTime(from))
+	}
+	if values.Get("to") != "" {
+		var to time.Time
+		to, err = ParseTimeParam(values.Get("to"), loc)
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+		conditions = append(conditions, "heartbeat_time<?")
+		args = append(args, DbTime(to))
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	response.Header().Set("Content-Type", EXPORT_FORMATS[format]["content_type"])
+	response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="lnx801-%s-%s.%s"`, kind, time.Now().Format("20060102150405"), EXPORT_FORMATS[format]["ext"]))
+
+	var exporter *Exporter
+	exporter = &Exporter{Format: format, Sheet: kind, Columns: columns, Writer: response}
+	err = exporter.Begin()
+	if err != nil {
+		Skip(err)
+		return
+	}
+
+	var query string
+	query = `
+		SELECT %s, CAST(heartbeat_time AS TEXT)
+		FROM %s
+		WHERE %s AND heartbeat_time>=? AND (heartbeat_time>? OR id>?)
+		ORDER BY heartbeat_time, id
+		LIMIT ?
+	`
+	query = fmt.Sprintf(query, strings.Join(columns, ", "), table, strings.Join(conditions, " AND "))
+
+	var key string
+	var id int64
+	for {
+		var chunk [][]interface{}
+		{
+			var rows *sql.Rows
+			rows, err = db.Query(query, append(args, key, key, id, EXPORT_CHUNK)...)
+			Raise(err)
+
+			for rows.Next() {
+				var id2 int64
+				var agent_id string
+				var ip string
+				var mac string
+				var name string
+				var heartbeat_time time.Time
+				var online int64
+				var source string
+				var key2 string
+
+				if table == "device" {
+					err = rows.Scan(&id2, &agent_id, &ip, &mac, &name, &heartbeat_time, &online, &key2)
+				} else {
+					err = rows.Scan(&id2, &agent_id, &ip, &mac, &name, &heartbeat_time, &source, &key2)
+				}
+				if err != nil {
+					rows.Close()
+					Raise(err)
+				}
+
+				var row []interface{}
+				row = []interface{}{id2, agent_id, ip, mac, name, FormatApiTime(heartbeat_time)}
+				if table == "device" {
+					row = append(row, online)
+				} else {
+					row = append(row, source)
+				}
+				chunk = append(chunk, row)
+
+				key = key2
+				id = id2
+			}
+			err = rows.Err()
+			rows.Close()
+			Raise(err)
+		}
+
+		var row []interface{}
+		for _, row = range chunk {
+			err = exporter.Row(row)
+			if err != nil {
+				// the client went away
+				Skip(err)
+				return
+			}
+		}
+
+		err = exporter.Flush()
+		if err != nil {
+			Skip(err)
+			return
+		}
+		var flusher http.Flusher
+		flusher, ok = response.(http.Flusher)
+		if ok {
+			flusher.Flush()
+		}
+
+		if len(chunk) < EXPORT_CHUNK {
+			break
+		}
+	}
+
+	err = exporter.End()
+	Skip(err)
+
+	log.Println("exported:", kind, format, exporter.Rows)
+}
+
+func Register(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var body []byte
+	body, err = ioutil.ReadAll(request.Body)
+	log.Println("body:", string(body))
+	Raise(err)
+
+	var data struct {
+		AgentId  string   `json:"agent_id"`
+		Hostname string   `json:"hostname"`
+		Version  string   `json:"version"`
+		Cidrs    []string `json:"cidrs"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		log.Println(err)
+		Api(response, 400)
+		return
+	}
+
+	log.Printf("data: %+v\n", data)
+
+	data.AgentId = strings.TrimSpace(data.AgentId)
+	if data.AgentId == "" {
+		Api(response, 400)
+		return
+	}
+
+	if !TokenAllowsAgent(request, data.AgentId) {
+		log.Println("token not allowed for agent:", data.AgentId)
+		Api(response, 403)
+		return
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var now string
+	now = DbTime(time.Now())
+
+	var query string
+	query = `
+		INSERT INTO agent (agent_id, hostname, version, cidrs, register_time, report_time)
+		VALUES (?,?,?,?,?,NULL)
+		ON CONFLICT (agent_id) DO UPDATE SET
+			hostname=excluded.hostname,
+			version=excluded.version,
+			cidrs=excluded.cidrs,
+			register_time=excluded.register_time
+	`
+	_, err = db.Exec(query, data.AgentId, data.Hostname, data.Version, strings.Join(data.Cidrs, ","), now)
+	Raise(err)
+
+	Api(response, 200)
+}
+
+func Agents(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = `
+		SELECT
+			a.id, a.agent_id, a.hostname, a.version, a.cidrs, a.register_time, a.report_time,
+			(SELECT COUNT(*) FROM device d WHERE d.agent_id=a.agent_id)
+		FROM agent a
+		ORDER BY a.agent_id
+	`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	defer rows.Close()
+	Raise(err)
+
+	var agents []map[string]interface{}
+	agents = make([]map[string]interface{}, 0)
+
+	var now time.Time
+	now = time.Now()
+
+	for rows.Next() {
+		var id int64
+		var agent_id string
+		var hostname string
+		var version string
+		var cidrs string
+		var register_time time.Time
+		var report_time sql.NullTime
+		var devices int64
+
+		err = rows.Scan(&id, &agent_id, &hostname, &version, &cidrs, &register_time, &report_time, &devices)
+		Raise(err)
+
+		var register_time2 string
+		register_time2 = register_time.In(time.Local).Format("2006-01-02 15:04:05")
+
+		// agents scan every minute, give them a few rounds before calling them stale
+		var health string
+		var report_time2 string
+		health = "offline"
+		report_time2 = ""
+		if report_time.Valid {
+			report_time2 = report_time.Time.In(time.Local).Format("2006-01-02 15:04:05")
+
+			var time_offset time.Duration
+			time_offset = now.Sub(report_time.Time)
+			if time_offset <= 5*time.Minute {
+				health = "online"
+			} else if time_offset <= 1*time.Hour {
+				health = "stale"
+			}
+		}
+
+		agents = append(
+			agents,
+			map[string]interface{}{
+				"id":            id,
+				"agent_id":      agent_id,
+				"hostname":      hostname,
+				"version":       version,
+				"cidrs":         cidrs,
+				"register_time": register_time2,
+				"report_time":   report_time2,
+				"devices":       devices,
+				"health":        health,
+			},
+		)
+	}
+
+	var data struct {
+		User   map[string]interface{}   `json:"-"`
+		Agents []map[string]interface{} `json:"agents"`
+	}
+	data.User = CurrentUser(request)
+	data.Agents = agents
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/agents.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/agents.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+// every type AddEvent is called with, the api spec documents these
+var EVENT_TYPES = []string{
+	"new", "online", "offline",
+	"wake", "wake_online", "wake_timeout",
+	"port_open", "port_closed",
+	"latency_high", "latency_ok", "loss_high", "loss_ok",
+}
+
+func AddEvent(db *sql.DB, event_type string, agent_id string, ip string, mac string, name string, message string, event_time string) {
+	var err error
+
+	log.Println("event:", event_type, agent_id, ip, mac, name, message, event_time)
+
+	var query string
+	query = `INSERT INTO event (type, agent_id, ip, mac, name, message, event_time) VALUES (?,?,?,?,?,?,?)`
+	_, err = db.Exec(query, event_type, agent_id, ip, mac, name, message, event_time)
+	Raise(err)
+
+	AddMetric("lnx801_events_total", map[string]string{"type": event_type}, 1)
+
+	PublishDevice(event_type, agent_id, ip, mac, name, event_time, map[string]interface{}{"message": message})
+}
+
+// Hub fans events out to the dashboards listening on /events/stream. A
+// subscriber that does not keep up is dropped instead of slowing Report down,
+// its channel is closed and the browser reloads to catch up.
+type Hub struct {
+	sync.Mutex
+	Subscribers map[chan map[string]interface{}]bool
+	Sequence    int64
+}
+
+var HUB = &Hub{Subscribers: make(map[chan map[string]interface{}]bool)}
+
+const HUB_BUFFER = 256
+
+func (hub *Hub) Subscribe() chan map[string]interface{} {
+	hub.Lock()
+	defer hub.Unlock()
+
+	var ch chan map[string]interface{}
+	ch = make(chan map[string]interface{}, HUB_BUFFER)
+	hub.Subscribers[ch] = true
+	log.Println("hub subscribers:", len(hub.Subscribers))
+	return ch
+}
+
+func (hub *Hub) Unsubscribe(ch chan map[string]interface{}) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if hub.Subscribers[ch] {
+		delete(hub.Subscribers, ch)
+		close(ch)
+	}
+}
+
+func (hub *Hub) Publish(event_type string, data map[string]interface{}) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	hub.Sequence += 1
+
+	var event map[string]interface{}
+	event = map[string]interface{}{"id": hub.Sequence, "type": event_type, "data": data}
+
+	var ch chan map[string]interface{}
+	for ch = range hub.Subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Println("hub dropping slow subscriber")
+			delete(hub.Subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// PublishDevice sends what a dashboard row shows, event_time is the UTC
+// "2006-01-02 15:04:05" the database holds and the heartbeat itself for
+// heartbeat events
+func PublishDevice(event_type string, agent_id string, ip string, mac string, name string, event_time string, extra map[string]interface{}) {
+	var err error
+
+	var event_time2 time.Time
+	event_time2, err = time.ParseInLocation("2006-01-02 15:04:05", event_time, time.UTC)
+	if err != nil {
+		Skip(err)
+		return
+	}
+
+	var data map[string]interface{}
+	data = map[string]interface{}{
+		"agent_id":  agent_id,
+		"ip":        ip,
+		"mac":       mac,
+		"name":      name,
+		"time":      event_time2.In(time.Local).Format("2006-01-02 15:04:05"),
+		"time_unix": event_time2.Unix(),
+	}
+
+	var key string
+	var value interface{}
+	for key, value = range extra {
+		data[key] = value
+	}
+
+	HUB.Publish(event_type, data)
+}
+
+func EventStream(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var flusher http.Flusher
+	var ok bool
+	flusher, ok = response.(http.Flusher)
+	if !ok {
+		Api(response, 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+
+	var ch chan map[string]interface{}
+	ch = HUB.Subscribe()
+	defer HUB.Unsubscribe(ch)
+
+	var event map[string]interface{}
+
+	_, err = fmt.Fprint(response, "retry: 5000\n\n")
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// a comment now and then keeps proxies from closing an idle stream
+	var ticker *time.Ticker
+	ticker = time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(response, ": ping\n\n")
+		case event, ok = <-ch:
+			if !ok {
+				fmt.Fprint(response, "event: lagged\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+
+			var body []byte
+			body, err = json.Marshal(event["data"])
+			Raise(err)
+
+			_, err = fmt.Fprintf(response, "id: %d\nevent: %s\ndata: %s\n\n", event["id"], event["type"], body)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// WatchDevices marks devices offline once their heartbeat is older than
+// OFFLINE_AFTER, Report brings them back online
+func WatchDevices() {
+	for {
+		func() {
+			defer Catch()
+
+			var err error
+
+			var db *sql.DB
+			db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+			defer db.Close()
+			Raise(err)
+
+			var now time.Time
+			now = time.Now()
+
+			var query string
+			query = `SELECT id, agent_id, ip, mac, name FROM device WHERE online=1 AND heartbeat_time<?`
+
+			var rows *sql.Rows
+			rows, err = db.Query(query, DbTime(now.Add(-OFFLINE_AFTER)))
+			defer rows.Close()
+			Raise(err)
+
+			var devices []map[string]interface{}
+			for rows.Next() {
+				var id int64
+				var agent_id string
+				var ip string
+				var mac string
+				var name string
+
+				err = rows.Scan(&id, &agent_id, &ip, &mac, &name)
+				Raise(err)
+
+				devices = append(devices, map[string]interface{}{"id": id, "agent_id": agent_id, "ip": ip, "mac": mac, "name": name})
+			}
+			Raise(rows.Err())
+			rows.Close()
+
+			var device map[string]interface{}
+			for _, device = range devices {
+				_, err = db.Exec(`UPDATE device SET online=0 WHERE id=?`, device["id"])
+				Raise(err)
+
+				AddEvent(db, "offline", device["agent_id"].(string), device["ip"].(string), device["mac"].(string), device["name"].(string), "no heartbeat", DbTime(now))
+			}
+
+			WatchWakes(db, now)
+		}()
+
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// a wake that has not brought the device online by then has failed, and an
+// agent that has not picked up a wake by then should not send it any more
+const WAKE_TIMEOUT = 10 * time.Minute
+
+var WAKE_VIAS = []string{"agent", "server"}
+
+// MagicPacket is six 0xff followed by the mac sixteen times
+func MagicPacket(mac string) ([]byte, error) {
+	var err error
+
+	var hardware_addr net.HardwareAddr
+	hardware_addr, err = net.ParseMAC(mac)
+	if err != nil || len(hardware_addr) != 6 {
+		return nil, errors.New(fmt.Sprintf("invalid mac %q", mac))
+	}
+
+	var packet []byte
+	packet = bytes.Repeat([]byte{0xff}, 6)
+
+	var i int
+	for i = 0; i < 16; i++ {
+		packet = append(packet, hardware_addr...)
+	}
+	return packet, nil
+}
+
+// WakeBroadcasts are the limited broadcast plus the directed broadcast of
+// every subnet of the agent that holds ip, routers may forward the latter
+func WakeBroadcasts(cidrs []string, ip string) []string {
+	var broadcasts []string
+	broadcasts = []string{"255.255.255.255"}
+
+	var addr netip.Addr
+	var err error
+	addr, err = netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return broadcasts
+	}
+
+	var cidr string
+	for _, cidr = range cidrs {
+		var prefix netip.Prefix
+		prefix, err = netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil || !prefix.Addr().Is4() || !prefix.Contains(addr) || prefix.Bits() >= 31 {
+			continue
+		}
+
+		var bytes4 [4]byte
+		bytes4 = prefix.Masked().Addr().As4()
+
+		var i int
+		for i = prefix.Bits(); i < 32; i++ {
+			bytes4[i/8] |= 1 << (7 - i%8)
+		}
+		broadcasts = append(broadcasts, netip.AddrFrom4(bytes4).String())
+	}
+
+	return broadcasts
+}
+
+// SendMagicPacket sends to UDP port 9 of every broadcast address and only
+// fails when none of them could be sent to
+func SendMagicPacket(mac string, broadcasts []string) error {
+	var err error
+
+	var packet []byte
+	packet, err = MagicPacket(mac)
+	if err != nil {
+		return err
+	}
+
+	var conn net.PacketConn
+	conn, err = net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var sent int
+	var broadcast string
+	for _, broadcast = range broadcasts {
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp4", net.JoinHostPort(broadcast, "9"))
+		if err != nil {
+			Skip(err)
+			continue
+		}
+
+		_, err = conn.WriteTo(packet, addr)
+		if err != nil {
+			Skip(err)
+			continue
+		}
+		sent += 1
+	}
+
+	if sent == 0 {
+		return err
+	}
+	return nil
+}
+
+func ScanWake(rows interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+	var err error
+
+	var id int64
+	var device_id int64
+	var agent_id string
+	var ip string
+	var mac string
+	var via string
+	var status string
+	var message string
+	var request_user string
+	var request_time time.Time
+	var send_time sql.NullTime
+	var online_time sql.NullTime
+
+	err = rows.Scan(&id, &device_id, &agent_id, &ip, &mac, &via, &status, &message, &request_user, &request_time, &send_time, &online_time)
+	if err != nil {
+		return nil, err
+	}
+
+	var send_time2 string
+	if send_time.Valid {
+		send_time2 = FormatApiTime(send_time.Time)
+	}
+	var online_time2 string
+	if online_time.Valid {
+		online_time2 = FormatApiTime(online_time.Time)
+	}
+
+	return map[string]interface{}{
+		"id":           id,
+		"device_id":    device_id,
+		"agent_id":     agent_id,
+		"ip":           ip,
+		"mac":          mac,
+		"via":          via,
+		"status":       status,
+		"message":      message,
+		"request_user": request_user,
+		"request_time": FormatApiTime(request_time),
+		"send_time":    send_time2,
+		"online_time":  online_time2,
+	}, nil
+}
+
+const WAKE_COLUMNS = `id, device_id, agent_id, ip, mac, via, status, message, request_user, request_time, send_time, online_time`
+
+func LoadWakes(db *sql.DB, device_id int64, limit int) []map[string]interface{} {
+	var err error
+
+	var query string
+	query = `SELECT ` + WAKE_COLUMNS + ` FROM wake WHERE device_id=? ORDER BY id DESC LIMIT ?`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, device_id, limit)
+	defer rows.Close()
+	Raise(err)
+
+	var wakes []map[string]interface{}
+	wakes = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var wake map[string]interface{}
+		wake, err = ScanWake(rows)
+		Raise(err)
+		wakes = append(wakes, wake)
+	}
+	Raise(rows.Err())
+
+	return wakes
+}
+
+// RequestWake records a wake and sends it right away when the server does it,
+// a wake via the agent waits for the agent's next report. via may be empty to
+// prefer the agent.
+func RequestWake(db *sql.DB, device map[string]interface{}, via string, request_user string) (map[string]interface{}, error) {
+	var err error
+
+	var agent_id string
+	var ip string
+	var mac string
+	var name string
+	agent_id = device["agent_id"].(string)
+	ip = device["ip"].(string)
+	mac = device["mac"].(string)
+	name = device["name"].(string)
+
+	if via == "" {
+		via = "server"
+		if agent_id != "" {
+			via = "agent"
+		}
+	}
+	if via != "agent" && via != "server" {
+		return nil, errors.New("via must be one of " + strings.Join(WAKE_VIAS, ", "))
+	}
+	if via == "agent" && agent_id == "" {
+		return nil, errors.New("the device has no agent to relay the wake")
+	}
+
+	_, err = MagicPacket(mac)
+	if err != nil {
+		return nil, errors.New("the device has no usable mac")
+	}
+
+	var now time.Time
+	now = time.Now()
+
+	var status string
+	var message string
+	var send_time interface{}
+	status = "pending"
+	if via == "server" {
+		var cidrs string
+		err = db.QueryRow(`SELECT cidrs FROM agent WHERE agent_id=?`, agent_id).Scan(&cidrs)
+		if err != sql.ErrNoRows {
+			Raise(err)
+		}
+
+		err = SendMagicPacket(mac, WakeBroadcasts(strings.Split(cidrs, ","), ip))
+		if err != nil {
+			status = "failed"
+			message = err.Error()
+		} else {
+			status = "sent"
+			send_time = DbTime(now)
+		}
+		AddMetric("lnx801_wakes_total", map[string]string{"via": via, "status": status}, 1)
+	}
+
+	var query string
+	query = `
+		INSERT INTO wake (device_id, agent_id, ip, mac, via, status, message, request_user, request_time, send_time)
+		VALUES (?,?,?,?,?,?,?,?,?,?)
+	`
+
+	var result sql.Result
+	result, err = db.Exec(query, device["id"], agent_id, ip, mac, via, status, message, request_user, DbTime(now), send_time)
+	Raise(err)
+
+	var id int64
+	id, err = result.LastInsertId()
+	Raise(err)
+
+	AddEvent(db, "wake", agent_id, ip, mac, name, fmt.Sprintf("wake via %s by %s: %s", via, request_user, status), DbTime(now))
+
+	return ScanWake(db.QueryRow(`SELECT `+WAKE_COLUMNS+` FROM wake WHERE id=?`, id))
+}
+
+// a relayed wake the agent has not acknowledged by then is relayed again,
+// the response that carried it may never have arrived
+const WAKE_RELAY_RETRY = 2 * time.Minute
+
+// AckWakes settles the relayed wakes an agent lists with its report as
+// id:result pairs, result is sent or failed
+func AckWakes(db *sql.DB, agent_id string, acks string) {
+	var err error
+
+	var ack string
+	for _, ack = range strings.Split(acks, ",") {
+		var parts []string
+		parts = strings.SplitN(ack, ":", 2)
+		if len(parts) != 2 || (parts[1] != "sent" && parts[1] != "failed") {
+			continue
+		}
+
+		var id int64
+		id, err = strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var message string
+		if parts[1] == "failed" {
+			message = "the agent could not send the magic packet"
+		}
+
+		var result sql.Result
+		result, err = db.Exec(`UPDATE wake SET status=?, message=? WHERE id=? AND agent_id=? AND status='relayed'`, parts[1], message, id, agent_id)
+		Raise(err)
+
+		var count int64
+		count, err = result.RowsAffected()
+		Raise(err)
+		if count > 0 {
+			AddMetric("lnx801_wakes_total", map[string]string{"via": "agent", "status": parts[1]}, 1)
+		}
+	}
+}
+
+// RelayWakes hands the pending wakes of an agent to it, they go out with
+// the response to its report. Relayed wakes the agent did not acknowledge
+// within WAKE_RELAY_RETRY go out again.
+func RelayWakes(db *sql.DB, agent_id string) []map[string]interface{} {
+	var err error
+
+	var now time.Time
+	now = time.Now()
+
+	var query string
+	query = `
+		SELECT id, ip, mac FROM wake
+		WHERE agent_id=? AND via='agent' AND (status='pending' OR (status='relayed' AND send_time<?)) AND request_time>=?
+	`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, agent_id, DbTime(now.Add(-WAKE_RELAY_RETRY)), DbTime(now.Add(-WAKE_TIMEOUT)))
+	defer rows.Close()
+	Raise(err)
+
+	var commands []map[string]interface{}
+	commands = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var id int64
+		var ip string
+		var mac string
+		err = rows.Scan(&id, &ip, &mac)
+		Raise(err)
+
+		commands = append(commands, map[string]interface{}{"id": id, "type": "wake", "ip": ip, "mac": mac})
+	}
+	Raise(rows.Err())
+	rows.Close()
+
+	var command map[string]interface{}
+	for _, command = range commands {
+		_, err = db.Exec(`UPDATE wake SET status='relayed', send_time=? WHERE id=?`, DbTime(now), command["id"])
+		Raise(err)
+
+		AddMetric("lnx801_wakes_total", map[string]string{"via": "agent", "status": "relayed"}, 1)
+	}
+
+	return commands
+}
+
+// WatchWakes settles wakes: online once a heartbeat newer than the packet
+// arrives, timeout when none does or the agent never picked the wake up
+func WatchWakes(db *sql.DB, now time.Time) {
+	var err error
+
+	var query string
+	query = `
+		SELECT wake.id, wake.agent_id, wake.ip, wake.mac, wake.status, wake.request_time, device.name, device.heartbeat_time
+		FROM wake
+		JOIN device ON device.id=wake.device_id
+		WHERE wake.status IN ('pending', 'sent', 'relayed')
+	`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	defer rows.Close()
+	Raise(err)
+
+	var wakes []map[string]interface{}
+	for rows.Next() {
+		var id int64
+		var agent_id string
+		var ip string
+		var mac string
+		var status string
+		var request_time time.Time
+		var name string
+		var heartbeat_time time.Time
+
+		err = rows.Scan(&id, &agent_id, &ip, &mac, &status, &request_time, &name, &heartbeat_time)
+		Raise(err)
+
+		wakes = append(wakes, map[string]interface{}{
+			"id": id, "agent_id": agent_id, "ip": ip, "mac": mac, "status": status,
+			"request_time": request_time, "name": name, "heartbeat_time": heartbeat_time,
+		})
+	}
+	Raise(rows.Err())
+	rows.Close()
+
+	var wake map[string]interface{}
+	for _, wake = range wakes {
+		var request_time time.Time
+		var heartbeat_time time.Time
+		request_time = wake["request_time"].(time.Time)
+		heartbeat_time = wake["heartbeat_time"].(time.Time)
+
+		var status string
+		var message string
+		var event_time time.Time
+		if wake["status"] != "pending" && heartbeat_time.After(request_time) {
+			status = "online"
+			message = fmt.Sprintf("online %s after wake", heartbeat_time.Sub(request_time).Round(time.Second))
+			event_time = heartbeat_time
+		} else if now.Sub(request_time) > WAKE_TIMEOUT {
+			status = "timeout"
+			message = fmt.Sprintf("not online %s after wake", WAKE_TIMEOUT)
+			if wake["status"] == "pending" {
+				message = "the agent did not report in time to relay the wake"
+			} else if wake["status"] == "relayed" {
+				message = "the agent never acknowledged the wake"
+			}
+			event_time = now
+		} else {
+			continue
+		}
+
+		if status == "online" {
+			_, err = db.Exec(`UPDATE wake SET status=?, message=?, online_time=? WHERE id=?`, status, message, DbTime(heartbeat_time), wake["id"])
+		} else {
+			_, err = db.Exec(`UPDATE wake SET status=?, message=? WHERE id=?`, status, message, wake["id"])
+		}
+		Raise(err)
+
+		AddEvent(db, "wake_"+status, wake["agent_id"].(string), wake["ip"].(string), wake["mac"].(string), wake["name"].(string), message, DbTime(event_time))
+	}
+}
+
+func WakeForm(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, request.PostFormValue("id"))
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	_, err = RequestWake(db, device, request.PostFormValue("via"), CurrentUser(request)["username"].(string))
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var next string
+	next = request.PostFormValue("next")
+	if next == "" {
+		next = fmt.Sprintf("/device?id=%d", device["id"])
+	}
+	http.Redirect(response, request, SafeNext(next), http.StatusSeeOther)
+}
+
+// ParseReportPing checks what an agent measured pinging a device, times are
+// in ms and loss in percent. A ping that got no reply has no times.
+func ParseReportPing(value interface{}) (map[string]interface{}, error) {
+	var input map[string]interface{}
+	var ok bool
+	input, ok = value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("ping must be an object")
+	}
+
+	var ping map[string]interface{}
+	ping = make(map[string]interface{})
+
+	var lost bool
+	lost = input["received"] == 0.0
+
+	var field string
+	for _, field = range []string{"sent", "received", "loss", "rtt_min", "rtt_avg", "rtt_max", "jitter"} {
+		if lost && field != "sent" && field != "received" && field != "loss" {
+			if input[field] != nil {
+				return nil, errors.New(fmt.Sprintf("%s must be null without replies", field))
+			}
+			ping[field] = nil
+			continue
+		}
+
+		var number float64
+		number, ok = input[field].(float64)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s must be a number", field))
+		}
+		if number < 0 || number > 60000 {
+			return nil, errors.New(fmt.Sprintf("%s out of range", field))
+		}
+		ping[field] = number
+	}
+
+	if ping["sent"].(float64) < 1 || ping["received"].(float64) > ping["sent"].(float64) {
+		return nil, errors.New("received must not exceed sent")
+	}
+	if ping["loss"].(float64) > 100 {
+		return nil, errors.New("loss must be a percentage")
+	}
+	if lost {
+		if ping["loss"].(float64) != 100 {
+			return nil, errors.New("loss must be 100 without replies")
+		}
+		return ping, nil
+	}
+	if ping["rtt_min"].(float64) > ping["rtt_avg"].(float64) || ping["rtt_avg"].(float64) > ping["rtt_max"].(float64) {
+		return nil, errors.New("rtt_min, rtt_avg and rtt_max out of order")
+	}
+
+	return ping, nil
+}
+
+// CheckPing raises or clears the latency and loss alerts of a device from its
+// last PING_WINDOW pings, once the window is full. Loss counts the pings
+// that got no reply, latency only the ones that did.
+func CheckPing(db *sql.DB, agent_id string, ip string, mac string, name string, heartbeat_time string) {
+	var err error
+
+	var rtt_avg float64
+	var loss float64
+	var samples int64
+	var replies int64
+	{
+		var query string
+		query = `
+			SELECT IFNULL(AVG(rtt_avg), 0), IFNULL(AVG(loss), 0), COUNT(*), COUNT(rtt_avg) FROM (
+				SELECT rtt_avg, loss, heartbeat_time FROM device_log
+				WHERE agent_id=? AND ip=? AND loss IS NOT NULL
+				UNION ALL
+				SELECT NULL, 100, probe_time FROM ping_loss
+				WHERE agent_id=? AND ip=?
+				ORDER BY 3 DESC LIMIT ?
+			)
+		`
+		err = db.QueryRow(query, agent_id, ip, agent_id, ip, PING_WINDOW).Scan(&rtt_avg, &loss, &samples, &replies)
+		Raise(err)
+	}
+	if samples < PING_WINDOW {
+		return
+	}
+
+	var alerts map[string]int64
+	alerts = make(map[string]int64)
+	{
+		var latency_alert int64
+		var loss_alert int64
+		err = db.QueryRow(`SELECT latency_alert, loss_alert FROM device WHERE agent_id=? AND ip=?`, agent_id, ip).Scan(&latency_alert, &loss_alert)
+		Raise(err)
+		alerts["latency"] = latency_alert
+		alerts["loss"] = loss_alert
+	}
+
+	var checks []map[string]interface{}
+	checks = []map[string]interface{}{
+		{"kind": "latency", "value": rtt_avg, "samples": replies, "threshold": SETTINGS.LATENCY_THRESHOLD, "message": "average round trip %.1f ms over the last %d pings, threshold %.1f ms"},
+		{"kind": "loss", "value": loss, "samples": samples, "threshold": SETTINGS.LOSS_THRESHOLD, "message": "average packet loss %.1f%% over the last %d pings, threshold %.1f%%"},
+	}
+
+	var check map[string]interface{}
+	for _, check = range checks {
+		var kind string
+		var value float64
+		var threshold float64
+		kind = check["kind"].(string)
+		value = check["value"].(float64)
+		threshold = check["threshold"].(float64)
+
+		// without a reply in the window there is no latency to judge
+		if kind == "latency" && replies == 0 {
+			continue
+		}
+
+		var alert int64
+		alert = alerts[kind]
+		if threshold > 0 && alert == 0 && value > threshold {
+			alert = 1
+		} else if alert == 1 && (threshold <= 0 || value < threshold*PING_RECOVER) {
+			alert = 0
+		}
+		if alert == alerts[kind] {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf(`UPDATE device SET %s_alert=? WHERE agent_id=? AND ip=?`, kind), alert, agent_id, ip)
+		Raise(err)
+
+		var event_type string
+		event_type = kind + "_ok"
+		if alert == 1 {
+			event_type = kind + "_high"
+		}
+		AddEvent(db, event_type, agent_id, ip, mac, name, fmt.Sprintf(check["message"].(string), value, check["samples"], threshold), heartbeat_time)
+	}
+}
+
+// ParseReportPorts checks the ports an agent found open on a device, every
+// port of the device that is not in the list was closed at scan time
+func ParseReportPorts(value interface{}) ([]map[string]interface{}, error) {
+	var items []interface{}
+	var ok bool
+	items, ok = value.([]interface{})
+	if !ok {
+		return nil, errors.New("ports must be a list")
+	}
+
+	var ports []map[string]interface{}
+	ports = make([]map[string]interface{}, 0)
+
+	var seen map[int64]bool
+	seen = make(map[int64]bool)
+
+	var item interface{}
+	for _, item = range items {
+		var input map[string]interface{}
+		input, ok = item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("ports must be a list of objects")
+		}
+
+		var number float64
+		number, ok = input["port"].(float64)
+		if !ok || number != float64(int64(number)) || number < 1 || number > 65535 {
+			return nil, errors.New("port must be 1-65535")
+		}
+		if seen[int64(number)] {
+			return nil, errors.New(fmt.Sprintf("port %d listed twice", int64(number)))
+		}
+		seen[int64(number)] = true
+
+		var port map[string]interface{}
+		port = map[string]interface{}{"port": int64(number)}
+
+		var field string
+		for _, field = range []string{"service", "banner", "tls_cn", "tls_sans"} {
+			var text string
+			text, ok = input[field].(string)
+			if !ok && input[field] != nil {
+				return nil, errors.New(fmt.Sprintf("%s must be a string", field))
+			}
+			if len(text) > 1000 {
+				text = text[:1000]
+			}
+			port[field] = text
+		}
+
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
+
+func PortLabel(port map[string]interface{}) string {
+	return strings.TrimSpace(fmt.Sprintf("%d/tcp %s %s", port["port"], port["service"], port["banner"]))
+}
+
+// SyncOpenPorts stores a port scan that finished at scan_time. The first scan
+// of a device only records what it found, later scans raise port_open and
+// port_closed events. A scan older than the last one stored is ignored.
+func SyncOpenPorts(db *sql.DB, device map[string]interface{}, ports []map[string]interface{}, scan_time string) {
+	var err error
+
+	var port_scan_time sql.NullTime
+	err = db.QueryRow(`SELECT port_scan_time FROM device WHERE id=?`, device["id"]).Scan(&port_scan_time)
+	Raise(err)
+
+	if port_scan_time.Valid && DbTime(port_scan_time.Time) >= scan_time {
+		log.Println("stale port scan:", device["agent_id"], device["ip"], scan_time)
+		return
+	}
+
+	var known map[int64]map[string]interface{}
+	known = make(map[int64]map[string]interface{})
+	{
+		var port map[string]interface{}
+		for _, port = range LoadOpenPorts(db, device["id"].(int64)) {
+			known[port["port"].(int64)] = port
+		}
+	}
+
+	var agent_id string
+	var ip string
+	var mac string
+	var name string
+	agent_id = device["agent_id"].(string)
+	ip = device["ip"].(string)
+	mac = device["mac"].(string)
+	name = device["name"].(string)
+
+	var port map[string]interface{}
+	for _, port = range ports {
+		var ok bool
+		_, ok = known[port["port"].(int64)]
+		if ok {
+			var query string
+			query = `UPDATE open_port SET service=?, banner=?, tls_cn=?, tls_sans=?, last_seen=? WHERE device_id=? AND port=?`
+			_, err = db.Exec(query, port["service"], port["banner"], port["tls_cn"], port["tls_sans"], scan_time, device["id"], port["port"])
+			Raise(err)
+
+			delete(known, port["port"].(int64))
+			continue
+		}
+
+		var query string
+		query = `INSERT INTO open_port (device_id, port, service, banner, tls_cn, tls_sans, first_seen, last_seen) VALUES (?,?,?,?,?,?,?,?)`
+		_, err = db.Exec(query, device["id"], port["port"], port["service"], port["banner"], port["tls_cn"], port["tls_sans"], scan_time, scan_time)
+		Raise(err)
+
+		if port_scan_time.Valid {
+			AddEvent(db, "port_open", agent_id, ip, mac, name, "port opened: "+PortLabel(port), scan_time)
+		}
+	}
+
+	for _, port = range known {
+		_, err = db.Exec(`DELETE FROM open_port WHERE device_id=? AND port=?`, device["id"], port["port"])
+		Raise(err)
+
+		AddEvent(db, "port_closed", agent_id, ip, mac, name, "port closed: "+PortLabel(port), scan_time)
+	}
+
+	_, err = db.Exec(`UPDATE device SET port_scan_time=? WHERE id=?`, scan_time, device["id"])
+	Raise(err)
+}
+
+func ScanOpenPort(rows interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+	var err error
+
+	var port int64
+	var service string
+	var banner string
+	var tls_cn string
+	var tls_sans string
+	var first_seen time.Time
+	var last_seen time.Time
+
+	err = rows.Scan(&port, &service, &banner, &tls_cn, &tls_sans, &first_seen, &last_seen)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"port":       port,
+		"protocol":   "tcp",
+		"service":    service,
+		"banner":     banner,
+		"tls_cn":     tls_cn,
+		"tls_sans":   tls_sans,
+		"first_seen": FormatApiTime(first_seen),
+		"last_seen":  FormatApiTime(last_seen),
+	}, nil
+}
+
+func LoadOpenPorts(db *sql.DB, device_id int64) []map[string]interface{} {
+	var err error
+
+	var query string
+	query = `SELECT port, service, banner, tls_cn, tls_sans, first_seen, last_seen FROM open_port WHERE device_id=? ORDER BY port`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, device_id)
+	defer rows.Close()
+	Raise(err)
+
+	var ports []map[string]interface{}
+	ports = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var port map[string]interface{}
+		port, err = ScanOpenPort(rows)
+		Raise(err)
+		ports = append(ports, port)
+	}
+	Raise(rows.Err())
+
+	return ports
+}
+
+// ParseReportSnmp checks what an agent read from a device over SNMP, the
+// interfaces and forwarding table replace what was stored before
+func ParseReportSnmp(value interface{}) (map[string]interface{}, error) {
+	var input map[string]interface{}
+	var ok bool
+	input, ok = value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("snmp must be an object")
+	}
+
+	var text = func(input map[string]interface{}, field string) (string, error) {
+		var value string
+		var ok bool
+		value, ok = input[field].(string)
+		if !ok && input[field] != nil {
+			return "", errors.New(fmt.Sprintf("%s must be a string", field))
+		}
+		if len(value) > 1000 {
+			value = value[:1000]
+		}
+		return value, nil
+	}
+	var number = func(input map[string]interface{}, field string) (int64, error) {
+		var value float64
+		var ok bool
+		value, ok = input[field].(float64)
+		if !ok && input[field] != nil {
+			return 0, errors.New(fmt.Sprintf("%s must be a number", field))
+		}
+		if value < 0 || value != float64(int64(value)) {
+			return 0, errors.New(fmt.Sprintf("%s must be a whole number", field))
+		}
+		return int64(value), nil
+	}
+
+	var err error
+
+	var snmp map[string]interface{}
+	snmp = make(map[string]interface{})
+
+	var field string
+	for _, field = range []string{"sys_name", "sys_descr", "sys_object_id"} {
+		snmp[field], err = text(input, field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	snmp["sys_uptime"], err = number(input, "sys_uptime")
+	if err != nil {
+		return nil, err
+	}
+
+	var items []interface{}
+	items, ok = input["interfaces"].([]interface{})
+	if !ok && input["interfaces"] != nil {
+		return nil, errors.New("interfaces must be a list")
+	}
+
+	var interfaces []map[string]interface{}
+	interfaces = make([]map[string]interface{}, 0)
+
+	var item interface{}
+	for _, item = range items {
+		var input2 map[string]interface{}
+		input2, ok = item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("interfaces must be a list of objects")
+		}
+
+		var iface map[string]interface{}
+		iface = make(map[string]interface{})
+		for _, field = range []string{"name", "descr", "alias", "mac", "admin_status", "oper_status"} {
+			iface[field], err = text(input2, field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, field = range []string{"index", "type", "speed", "bridge_port"} {
+			iface[field], err = number(input2, field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	snmp["interfaces"] = interfaces
+
+	items, ok = input["fdb"].([]interface{})
+	if !ok && input["fdb"] != nil {
+		return nil, errors.New("fdb must be a list")
+	}
+
+	var fdb []map[string]interface{}
+	fdb = make([]map[string]interface{}, 0)
+
+	for _, item = range items {
+		var input2 map[string]interface{}
+		input2, ok = item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("fdb must be a list of objects")
+		}
+
+		var entry map[string]interface{}
+		entry = make(map[string]interface{})
+
+		var mac string
+		mac, _ = input2["mac"].(string)
+
+		var hardware_addr net.HardwareAddr
+		hardware_addr, err = net.ParseMAC(mac)
+		if err != nil || len(hardware_addr) != 6 {
+			return nil, errors.New(fmt.Sprintf("invalid fdb mac: %v", input2["mac"]))
+		}
+		entry["mac"] = hardware_addr.String()
+
+		for _, field = range []string{"port", "if_index", "vlan"} {
+			entry[field], err = number(input2, field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fdb = append(fdb, entry)
+	}
+	snmp["fdb"] = fdb
+
+	items, ok = input["lldp"].([]interface{})
+	if !ok && input["lldp"] != nil {
+		return nil, errors.New("lldp must be a list")
+	}
+
+	var lldp []map[string]interface{}
+	lldp = make([]map[string]interface{}, 0)
+
+	for _, item = range items {
+		var input2 map[string]interface{}
+		input2, ok = item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("lldp must be a list of objects")
+		}
+
+		var neighbor map[string]interface{}
+		neighbor = make(map[string]interface{})
+		for _, field = range []string{"local_port_name", "chassis_id", "port_id", "port_descr", "sys_name", "mgmt_ip"} {
+			neighbor[field], err = text(input2, field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		neighbor["local_port"], err = number(input2, "local_port")
+		if err != nil {
+			return nil, err
+		}
+
+		// a mac chassis id is matched against device macs, keep one spelling
+		var hardware_addr net.HardwareAddr
+		hardware_addr, err = net.ParseMAC(neighbor["chassis_id"].(string))
+		if err == nil && len(hardware_addr) == 6 {
+			neighbor["chassis_id"] = hardware_addr.String()
+		}
+
+		if neighbor["mgmt_ip"] != "" && net.ParseIP(neighbor["mgmt_ip"].(string)) == nil {
+			return nil, errors.New(fmt.Sprintf("invalid lldp mgmt_ip: %v", input2["mgmt_ip"]))
+		}
+		lldp = append(lldp, neighbor)
+	}
+	snmp["lldp"] = lldp
+
+	return snmp, nil
+}
+
+// SyncSnmp stores an SNMP poll that finished at poll_time, a poll older than
+// the last one stored is ignored
+func SyncSnmp(db *sql.DB, device_id int64, snmp map[string]interface{}, poll_time string) {
+	var err error
+
+	var snmp_time sql.NullTime
+	err = db.QueryRow(`SELECT snmp_time FROM device WHERE id=?`, device_id).Scan(&snmp_time)
+	Raise(err)
+
+	if snmp_time.Valid && DbTime(snmp_time.Time) >= poll_time {
+		log.Println("stale snmp poll:", device_id, poll_time)
+		return
+	}
+
+	// a switch reports thousands of macs, one transaction instead of one
+	// per row
+	var tx *sql.Tx
+	tx, err = db.Begin()
+	Raise(err)
+	defer tx.Rollback()
+
+	{
+		var query string
+		query = `UPDATE device SET sys_name=?, sys_descr=?, sys_object_id=?, sys_uptime=?, snmp_time=? WHERE id=?`
+		_, err = tx.Exec(query, snmp["sys_name"], snmp["sys_descr"], snmp["sys_object_id"], snmp["sys_uptime"], poll_time, device_id)
+		Raise(err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM device_interface WHERE device_id=?`, device_id)
+	Raise(err)
+
+	var iface map[string]interface{}
+	for _, iface = range snmp["interfaces"].([]map[string]interface{}) {
+		var query string
+		query = `
+			INSERT INTO device_interface (device_id, if_index, name, descr, alias, type, speed, mac, admin_status, oper_status, bridge_port)
+			VALUES (?,?,?,?,?,?,?,?,?,?,?)
+			ON CONFLICT (device_id, if_index) DO NOTHING
+		`
+		_, err = tx.Exec(query, device_id, iface["index"], iface["name"], iface["descr"], iface["alias"], iface["type"], iface["speed"], iface["mac"], iface["admin_status"], iface["oper_status"], iface["bridge_port"])
+		Raise(err)
+	}
+
+	// first_seen survives as long as the mac stays in the table
+	var entry map[string]interface{}
+	for _, entry = range snmp["fdb"].([]map[string]interface{}) {
+		var query string
+		query = `
+			INSERT INTO fdb_entry (device_id, mac, port, if_index, vlan, first_seen, last_seen)
+			VALUES (?,?,?,?,?,?,?)
+			ON CONFLICT (device_id, mac) DO UPDATE SET port=excluded.port, if_index=excluded.if_index, vlan=excluded.vlan, last_seen=excluded.last_seen
+		`
+		_, err = tx.Exec(query, device_id, entry["mac"], entry["port"], entry["if_index"], entry["vlan"], poll_time, poll_time)
+		Raise(err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM fdb_entry WHERE device_id=? AND last_seen<?`, device_id, poll_time)
+	Raise(err)
+
+	_, err = tx.Exec(`DELETE FROM lldp_neighbor WHERE device_id=?`, device_id)
+	Raise(err)
+
+	var neighbor map[string]interface{}
+	for _, neighbor = range snmp["lldp"].([]map[string]interface{}) {
+		var query string
+		query = `
+			INSERT INTO lldp_neighbor (device_id, local_port, local_port_name, chassis_id, port_id, port_descr, sys_name, mgmt_ip)
+			VALUES (?,?,?,?,?,?,?,?)
+		`
+		_, err = tx.Exec(query, device_id, neighbor["local_port"], neighbor["local_port_name"], neighbor["chassis_id"], neighbor["port_id"], neighbor["port_descr"], neighbor["sys_name"], neighbor["mgmt_ip"])
+		Raise(err)
+	}
+
+	err = tx.Commit()
+	Raise(err)
+}
+
+// LoadSnmp is what SNMP told about a device, and for any device with a mac
+// the switch ports it was learned on, the port with the fewest macs first as
+// that is most likely where it is plugged in rather than an uplink
+func LoadSnmp(db *sql.DB, device map[string]interface{}) map[string]interface{} {
+	var err error
+
+	var snmp map[string]interface{}
+	{
+		var sys_name string
+		var sys_descr string
+		var sys_object_id string
+		var sys_uptime int64
+		var snmp_time sql.NullTime
+
+		var query string
+		query = `SELECT sys_name, sys_descr, sys_object_id, sys_uptime, snmp_time FROM device WHERE id=?`
+		err = db.QueryRow(query, device["id"]).Scan(&sys_name, &sys_descr, &sys_object_id, &sys_uptime, &snmp_time)
+		Raise(err)
+
+		var snmp_time2 string
+		if snmp_time.Valid {
+			snmp_time2 = FormatApiTime(snmp_time.Time)
+		}
+
+		snmp = map[string]interface{}{
+			"sys_name":      sys_name,
+			"sys_descr":     sys_descr,
+			"sys_object_id": sys_object_id,
+			"sys_uptime":    sys_uptime,
+			"snmp_time":     snmp_time2,
+		}
+	}
+
+	var interfaces []map[string]interface{}
+	interfaces = make([]map[string]interface{}, 0)
+	{
+		var query string
+		query = `
+			SELECT
+				device_interface.if_index, device_interface.name, device_interface.descr, device_interface.alias,
+				device_interface.type, device_interface.speed, device_interface.mac,
+				device_interface.admin_status, device_interface.oper_status, device_interface.bridge_port,
+				(SELECT COUNT(*) FROM fdb_entry WHERE fdb_entry.device_id=device_interface.device_id AND fdb_entry.if_index=device_interface.if_index)
+			FROM device_interface
+			WHERE device_interface.device_id=?
+			ORDER BY device_interface.if_index
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, device["id"])
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var if_index int64
+			var name string
+			var descr string
+			var alias string
+			var if_type int64
+			var speed int64
+			var mac string
+			var admin_status string
+			var oper_status string
+			var bridge_port int64
+			var macs int64
+
+			err = rows.Scan(&if_index, &name, &descr, &alias, &if_type, &speed, &mac, &admin_status, &oper_status, &bridge_port, &macs)
+			Raise(err)
+
+			interfaces = append(interfaces, map[string]interface{}{
+				"index":        if_index,
+				"name":         name,
+				"descr":        descr,
+				"alias":        alias,
+				"type":         if_type,
+				"speed":        speed,
+				"mac":          mac,
+				"admin_status": admin_status,
+				"oper_status":  oper_status,
+				"bridge_port":  bridge_port,
+				"macs":         macs,
+			})
+		}
+		Raise(rows.Err())
+	}
+	snmp["interfaces"] = interfaces
+
+	var fdb []map[string]interface{}
+	fdb = make([]map[string]interface{}, 0)
+	{
+		var query string
+		query = `
+			SELECT
+				fdb_entry.mac, fdb_entry.port, fdb_entry.if_index, fdb_entry.vlan, IFNULL(device_interface.name, ''),
+				fdb_entry.first_seen, fdb_entry.last_seen,
+				IFNULL((SELECT MIN(id) FROM device WHERE LOWER(device.mac)=fdb_entry.mac), 0)
+			FROM fdb_entry
+			LEFT JOIN device_interface ON device_interface.device_id=fdb_entry.device_id AND device_interface.if_index=fdb_entry.if_index
+			WHERE fdb_entry.device_id=?
+			ORDER BY fdb_entry.port, fdb_entry.mac
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, device["id"])
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var mac string
+			var port int64
+			var if_index int64
+			var vlan int64
+			var if_name string
+			var first_seen time.Time
+			var last_seen time.Time
+			var device_id int64
+
+			err = rows.Scan(&mac, &port, &if_index, &vlan, &if_name, &first_seen, &last_seen, &device_id)
+			Raise(err)
+
+			fdb = append(fdb, map[string]interface{}{
+				"mac":        mac,
+				"vendor":     Vendor(mac),
+				"port":       port,
+				"if_index":   if_index,
+				"vlan":       vlan,
+				"if_name":    if_name,
+				"first_seen": FormatApiTime(first_seen),
+				"last_seen":  FormatApiTime(last_seen),
+				"device_id":  device_id,
+			})
+		}
+		Raise(rows.Err())
+	}
+	snmp["fdb"] = fdb
+
+	snmp["lldp"] = LoadLldpNeighbors(db, device["id"].(int64))
+
+	var switch_ports []map[string]interface{}
+	switch_ports = make([]map[string]interface{}, 0)
+	if device["mac"] != "" {
+		var query string
+		query = `
+			SELECT
+				device.id, device.ip, device.name, device.sys_name,
+				fdb_entry.port, IFNULL(device_interface.name, ''), IFNULL(device_interface.alias, ''), fdb_entry.last_seen,
+				(SELECT COUNT(*) FROM fdb_entry AS other WHERE other.device_id=fdb_entry.device_id AND other.port=fdb_entry.port) AS macs
+			FROM fdb_entry
+			JOIN device ON device.id=fdb_entry.device_id
+			LEFT JOIN device_interface ON device_interface.device_id=fdb_entry.device_id AND device_interface.if_index=fdb_entry.if_index
+			WHERE fdb_entry.mac=?
+			ORDER BY macs, device.ip
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query, strings.ToLower(device["mac"].(string)))
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var switch_id int64
+			var ip string
+			var name string
+			var sys_name string
+			var port int64
+			var if_name string
+			var alias string
+			var last_seen time.Time
+			var macs int64
+
+			err = rows.Scan(&switch_id, &ip, &name, &sys_name, &port, &if_name, &alias, &last_seen, &macs)
+			Raise(err)
+
+			switch_ports = append(switch_ports, map[string]interface{}{
+				"switch_id": switch_id,
+				"ip":        ip,
+				"name":      name,
+				"sys_name":  sys_name,
+				"port":      port,
+				"if_name":   if_name,
+				"alias":     alias,
+				"last_seen": FormatApiTime(last_seen),
+				"macs":      macs,
+			})
+		}
+		Raise(rows.Err())
+	}
+	snmp["switch_ports"] = switch_ports
+
+	return snmp
+}
+
+// LoadLldpNeighbors lists what a switch heard over LLDP, with the device the
+// neighbor is when it is one we know by mac, management address or name
+func LoadLldpNeighbors(db *sql.DB, device_id int64) []map[string]interface{} {
+	var err error
+
+	var lldp []map[string]interface{}
+	lldp = make([]map[string]interface{}, 0)
+
+	var query string
+	query = `
+		SELECT local_port, local_port_name, chassis_id, port_id, port_descr, sys_name, mgmt_ip
+		FROM lldp_neighbor
+		WHERE device_id=?
+		ORDER BY local_port, id
+	`
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, device_id)
+	defer rows.Close()
+	Raise(err)
+
+	for rows.Next() {
+		var local_port int64
+		var local_port_name string
+		var chassis_id string
+		var port_id string
+		var port_descr string
+		var sys_name string
+		var mgmt_ip string
+
+		err = rows.Scan(&local_port, &local_port_name, &chassis_id, &port_id, &port_descr, &sys_name, &mgmt_ip)
+		Raise(err)
+
+		lldp = append(lldp, map[string]interface{}{
+			"local_port":      local_port,
+			"local_port_name": local_port_name,
+			"chassis_id":      chassis_id,
+			"port_id":         port_id,
+			"port_descr":      port_descr,
+			"sys_name":        sys_name,
+			"mgmt_ip":         mgmt_ip,
+		})
+	}
+	Raise(rows.Err())
+
+	var neighbor map[string]interface{}
+	for _, neighbor = range lldp {
+		neighbor["device_id"] = FindLldpDevice(db, neighbor)
+	}
+
+	return lldp
+}
+
+// FindLldpDevice is the device an LLDP neighbor announced itself as, 0 when
+// it is none we know
+func FindLldpDevice(db *sql.DB, neighbor map[string]interface{}) int64 {
+	var err error
+
+	var query string
+	query = `
+		SELECT id FROM device
+		WHERE (LOWER(mac)=? AND mac!='')
+			OR (ip=? AND ip!='')
+			OR (sys_name=? AND sys_name!='')
+			OR id IN (SELECT device_id FROM device_interface WHERE mac=? AND mac!='')
+		ORDER BY snmp_time IS NULL, id
+		LIMIT 1
+	`
+
+	var device_id int64
+	err = db.QueryRow(query, neighbor["chassis_id"], neighbor["mgmt_ip"], neighbor["sys_name"], neighbor["chassis_id"]).Scan(&device_id)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	Raise(err)
+
+	return device_id
+}
+
+// TopologyLink is a switch port LLDP heard another switch on
+type TopologyLink struct {
+	Port   int64
+	To     int64
+	PortId string
+}
+
+// TopologyEntry is where a switch learned a mac, counted per switch port
+// with the vlan left out
+type TopologyEntry struct {
+	SwitchId int64
+	Port     int64
+	Vlan     int64
+}
+
+// BuildTopology puts the polled switches in trees linked by LLDP, the first
+// rooted at root_id or else at the switch with the most links, and hangs
+// every mac of the forwarding tables on one switch port. A mac is learned
+// on each switch between it and where it is plugged in, so it goes on the
+// port with no other switch behind it and the fewest macs.
+func BuildTopology(db *sql.DB, root_id int64) map[string]interface{} {
+	var err error
+
+	var devices map[string][]map[string]interface{}
+	devices = make(map[string][]map[string]interface{})
+
+	var switches map[int64]map[string]interface{}
+	switches = make(map[int64]map[string]interface{})
+	var switch_ids []int64
+
+	// the switch a mac belongs to, its own or one of its interfaces
+	var switch_macs map[string]int64
+	switch_macs = make(map[string]int64)
+	{
+		var query string
+		query = `
+			SELECT id, agent_id, ip, mac, name, heartbeat_time, sys_name,
+				snmp_time IS NOT NULL AND (id IN (SELECT device_id FROM fdb_entry) OR id IN (SELECT device_id FROM lldp_neighbor))
+			FROM device
+			ORDER BY id
+		`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var id int64
+			var agent_id string
+			var ip string
+			var mac string
+			var name string
+			var heartbeat_time time.Time
+			var sys_name string
+			var polled bool
+
+			err = rows.Scan(&id, &agent_id, &ip, &mac, &name, &heartbeat_time, &sys_name, &polled)
+			Raise(err)
+
+			var device map[string]interface{}
+			device = map[string]interface{}{
+				"id":     id,
+				"ip":     ip,
+				"name":   name,
+				"online": time.Since(heartbeat_time) <= OFFLINE_AFTER,
+			}
+			mac = strings.ToLower(mac)
+			if mac != "" {
+				devices[mac] = append(devices[mac], device)
+			}
+
+			if polled {
+				device["sys_name"] = sys_name
+				device["uplink"] = ""
+				device["ports"] = make(map[int64]map[string]interface{})
+				switches[id] = device
+				switch_ids = append(switch_ids, id)
+				if mac != "" {
+					switch_macs[mac] = id
+				}
+			}
+		}
+		Raise(rows.Err())
+	}
+
+	var interfaces map[int64]map[int64]map[string]interface{}
+	interfaces = make(map[int64]map[int64]map[string]interface{})
+	{
+		var query string
+		query = `SELECT device_id, bridge_port, name, alias, mac, oper_status FROM device_interface ORDER BY device_id, if_index`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var device_id int64
+			var bridge_port int64
+			var name string
+			var alias string
+			var mac string
+			var oper_status string
+
+			err = rows.Scan(&device_id, &bridge_port, &name, &alias, &mac, &oper_status)
+			Raise(err)
+
+			if switches[device_id] == nil {
+				continue
+			}
+			if mac != "" && switch_macs[mac] == 0 {
+				switch_macs[mac] = device_id
+			}
+			if bridge_port == 0 {
+				continue
+			}
+			if interfaces[device_id] == nil {
+				interfaces[device_id] = make(map[int64]map[string]interface{})
+			}
+			interfaces[device_id][bridge_port] = map[string]interface{}{"name": name, "alias": alias, "oper_status": oper_status}
+		}
+		Raise(rows.Err())
+	}
+
+	// LLDP port numbers are bridge port numbers
+	var port = func(switch_id int64, number int64, lldp_name string) map[string]interface{} {
+		var ports map[int64]map[string]interface{}
+		ports = switches[switch_id]["ports"].(map[int64]map[string]interface{})
+		if ports[number] == nil {
+			var iface map[string]interface{}
+			iface = interfaces[switch_id][number]
+			if iface == nil {
+				iface = map[string]interface{}{"name": lldp_name, "alias": "", "oper_status": ""}
+			}
+			if iface["name"] == "" {
+				iface["name"] = fmt.Sprintf("port %d", number)
+			}
+			ports[number] = map[string]interface{}{
+				"port":        number,
+				"name":        iface["name"],
+				"alias":       iface["alias"],
+				"oper_status": iface["oper_status"],
+				"trunk":       false,
+				"switches":    make([]map[string]interface{}, 0),
+				"macs":        make([]map[string]interface{}, 0),
+			}
+		}
+		return ports[number]
+	}
+
+	var links map[int64][]TopologyLink
+	links = make(map[int64][]TopologyLink)
+	{
+		var lldp []map[string]interface{}
+
+		var switch_id int64
+		for _, switch_id = range switch_ids {
+			var neighbor map[string]interface{}
+			for _, neighbor = range LoadLldpNeighbors(db, switch_id) {
+				neighbor["switch_id"] = switch_id
+				lldp = append(lldp, neighbor)
+			}
+		}
+
+		var neighbor map[string]interface{}
+		for _, neighbor = range lldp {
+			var to int64
+			to = neighbor["device_id"].(int64)
+			if switches[to] == nil || to == neighbor["switch_id"] {
+				continue
+			}
+
+			var port2 map[string]interface{}
+			port2 = port(neighbor["switch_id"].(int64), neighbor["local_port"].(int64), neighbor["local_port_name"].(string))
+			port2["trunk"] = true
+
+			var port_id string
+			port_id = neighbor["port_id"].(string)
+			if port_id == "" {
+				port_id = neighbor["port_descr"].(string)
+			}
+			links[neighbor["switch_id"].(int64)] = append(links[neighbor["switch_id"].(int64)], TopologyLink{Port: neighbor["local_port"].(int64), To: to, PortId: port_id})
+		}
+	}
+
+	var entries map[string][]TopologyEntry
+	entries = make(map[string][]TopologyEntry)
+	var macs []string
+
+	var counts map[TopologyEntry]int64
+	counts = make(map[TopologyEntry]int64)
+	{
+		var query string
+		query = `SELECT device_id, mac, port, vlan FROM fdb_entry ORDER BY mac, device_id`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		defer rows.Close()
+		Raise(err)
+
+		for rows.Next() {
+			var entry TopologyEntry
+			var mac string
+
+			err = rows.Scan(&entry.SwitchId, &mac, &entry.Port, &entry.Vlan)
+			Raise(err)
+
+			if switches[entry.SwitchId] == nil {
+				continue
+			}
+			if entries[mac] == nil {
+				macs = append(macs, mac)
+			}
+			entries[mac] = append(entries[mac], entry)
+			counts[TopologyEntry{SwitchId: entry.SwitchId, Port: entry.Port}]++
+
+			// another switch's mac is behind an uplink
+			if switch_macs[mac] != 0 && switch_macs[mac] != entry.SwitchId {
+				port(entry.SwitchId, entry.Port, "")["trunk"] = true
+			}
+		}
+		Raise(rows.Err())
+	}
+
+	var attached int
+	var unknown int
+
+	var mac string
+	for _, mac = range macs {
+		if switch_macs[mac] != 0 {
+			continue
+		}
+
+		var best TopologyEntry
+		var best_score []int64
+
+		var entry TopologyEntry
+		for _, entry = range entries[mac] {
+			var trunk int64
+			if port(entry.SwitchId, entry.Port, "")["trunk"].(bool) {
+				trunk = 1
+			}
+
+			var score []int64
+			score = []int64{trunk, counts[TopologyEntry{SwitchId: entry.SwitchId, Port: entry.Port}], entry.SwitchId}
+			if best_score == nil || score[0] < best_score[0] || score[0] == best_score[0] && (score[1] < best_score[1] || score[1] == best_score[1] && score[2] < best_score[2]) {
+				best = entry
+				best_score = score
+			}
+		}
+
+		var devices2 []map[string]interface{}
+		devices2 = devices[mac]
+		if devices2 == nil {
+			devices2 = make([]map[string]interface{}, 0)
+			unknown++
+		}
+
+		var port2 map[string]interface{}
+		port2 = port(best.SwitchId, best.Port, "")
+		port2["macs"] = append(port2["macs"].([]map[string]interface{}), map[string]interface{}{
+			"mac":     mac,
+			"vendor":  Vendor(mac),
+			"vlan":    best.Vlan,
+			"devices": devices2,
+		})
+		attached++
+	}
+
+	if switches[root_id] == nil {
+		root_id = 0
+
+		var switch_id int64
+		for _, switch_id = range switch_ids {
+			if root_id == 0 || len(links[switch_id]) > len(links[root_id]) {
+				root_id = switch_id
+			}
+		}
+	}
+
+	// breadth first so every switch hangs off the shortest path from a root
+	var roots []map[string]interface{}
+	roots = make([]map[string]interface{}, 0)
+
+	var seen map[int64]bool
+	seen = make(map[int64]bool)
+
+	var starts []int64
+	if root_id != 0 {
+		starts = append(starts, root_id)
+	}
+	starts = append(starts, switch_ids...)
+
+	var start int64
+	for _, start = range starts {
+		if seen[start] {
+			continue
+		}
+		seen[start] = true
+		roots = append(roots, switches[start])
+
+		var queue []int64
+		queue = []int64{start}
+		for len(queue) > 0 {
+			var from int64
+			from = queue[0]
+			queue = queue[1:]
+
+			var link TopologyLink
+			for _, link = range links[from] {
+				if seen[link.To] {
+					continue
+				}
+				seen[link.To] = true
+				queue = append(queue, link.To)
+
+				// the child's own name for the port when it heard us too
+				switches[link.To]["uplink"] = link.PortId
+				var back TopologyLink
+				for _, back = range links[link.To] {
+					if back.To == from {
+						switches[link.To]["uplink"] = port(link.To, back.Port, "")["name"]
+						break
+					}
+				}
+
+				var port2 map[string]interface{}
+				port2 = port(from, link.Port, "")
+				port2["switches"] = append(port2["switches"].([]map[string]interface{}), switches[link.To])
+			}
+		}
+	}
+
+	var switch_id int64
+	for _, switch_id = range switch_ids {
+		var ports []map[string]interface{}
+		ports = make([]map[string]interface{}, 0)
+
+		var port2 map[string]interface{}
+		for _, port2 = range switches[switch_id]["ports"].(map[int64]map[string]interface{}) {
+			if port2["trunk"].(bool) || len(port2["switches"].([]map[string]interface{})) > 0 || len(port2["macs"].([]map[string]interface{})) > 0 {
+				ports = append(ports, port2)
+			}
+		}
+		sort.Slice(ports, func(i int, j int) bool {
+			return ports[i]["port"].(int64) < ports[j]["port"].(int64)
+		})
+		switches[switch_id]["ports"] = ports
+	}
+
+	return map[string]interface{}{
+		"root_id":  root_id,
+		"switches": roots,
+		"macs":     attached,
+		"unknown":  unknown,
+	}
+}
+
+// Topology is the switch and port tree, the root can be picked with ?root=
+func Topology(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var root_id int64
+	if request.URL.Query().Get("root") != "" {
+		root_id, err = strconv.ParseInt(request.URL.Query().Get("root"), 10, 64)
+		if err != nil {
+			ApiError(response, 400, "invalid root")
+			return
+		}
+	}
+
+	var data struct {
+		User     map[string]interface{} `json:"-"`
+		Topology map[string]interface{} `json:"topology"`
+	}
+	data.User = CurrentUser(request)
+	data.Topology = BuildTopology(db, root_id)
+
+	if strings.HasSuffix(request.URL.Path, ".json") {
+		Api(response, 200, data)
+	} else {
+		var tpl *template.Template
+		if SETTINGS.DEBUG {
+			tpl, err = template.ParseFiles("template/topology.html")
+		} else {
+			tpl, err = template.ParseFS(TEMPLATE, "template/topology.html")
+		}
+		Skip(err)
+		tpl.Execute(response, data)
+	}
+}
+
+func WriteMetricHelp(buf *bytes.Buffer, name string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, METRIC_HELP[name][1])
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, METRIC_HELP[name][0])
+}
+
+// Metrics renders the Prometheus text format. Device and agent gauges are read
+// from the database on every scrape, counters and latencies live in METRICS.
+func Metrics(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var buf bytes.Buffer
+
+	WriteMetricHelp(&buf, "lnx801_build_info")
+	fmt.Fprintf(&buf, "lnx801_build_info%s 1\n", MetricLabels(map[string]string{"version": SETTINGS.VERSION}))
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	{
+		var query string
+		query = `SELECT agent_id, ip, mac, name, heartbeat_time, online FROM device ORDER BY agent_id, ip`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		defer rows.Close()
+		Raise(err)
+
+		var up bytes.Buffer
+		var last_seen bytes.Buffer
+		for rows.Next() {
+			var agent_id string
+			var ip string
+			var mac string
+			var name string
+			var heartbeat_time time.Time
+			var online int64
+
+			err = rows.Scan(&agent_id, &ip, &mac, &name, &heartbeat_time, &online)
+			Raise(err)
+
+			var labels string
+			labels = MetricLabels(map[string]string{"agent_id": agent_id, "ip": ip, "mac": mac, "name": name})
+
+			fmt.Fprintf(&up, "lnx801_device_up%s %d\n", labels, online)
+			fmt.Fprintf(&last_seen, "lnx801_device_last_seen_seconds%s %d\n", labels, heartbeat_time.Unix())
+		}
+		Raise(rows.Err())
+
+		WriteMetricHelp(&buf, "lnx801_device_up")
+		buf.Write(up.Bytes())
+		WriteMetricHelp(&buf, "lnx801_device_last_seen_seconds")
+		buf.Write(last_seen.Bytes())
+	}
+
+	{
+		var query string
+		query = `SELECT agent_id, report_time FROM agent WHERE report_time IS NOT NULL ORDER BY agent_id`
+
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		defer rows.Close()
+		Raise(err)
+
+		WriteMetricHelp(&buf, "lnx801_agent_last_report_seconds")
+		for rows.Next() {
+			var agent_id string
+			var report_time time.Time
+
+			err = rows.Scan(&agent_id, &report_time)
+			Raise(err)
+
+			fmt.Fprintf(&buf, "lnx801_agent_last_report_seconds%s %d\n", MetricLabels(map[string]string{"agent_id": agent_id}), report_time.Unix())
+		}
+		Raise(rows.Err())
+	}
+
+	{
+		var page_count int64
+		var page_size int64
+		err = db.QueryRow(`PRAGMA page_count`).Scan(&page_count)
+		Raise(err)
+		err = db.QueryRow(`PRAGMA page_size`).Scan(&page_size)
+		Raise(err)
+
+		WriteMetricHelp(&buf, "lnx801_db_size_bytes")
+		fmt.Fprintf(&buf, "lnx801_db_size_bytes %d\n", page_count*page_size)
+	}
+
+	METRICS.Lock()
+	{
+		var series []string
+		var key string
+		for key = range METRICS.Counters {
+			series = append(series, key)
+		}
+		sort.Strings(series)
+
+		var previous string
+		for _, key = range series {
+			var name string
+			name = strings.SplitN(key, "{", 2)[0]
+			if name != previous {
+				WriteMetricHelp(&buf, name)
+				previous = name
+			}
+			fmt.Fprintf(&buf, "%s %v\n", key, METRICS.Counters[key])
+		}
+	}
+	{
+		var handlers []string
+		var handler string
+		for handler = range METRICS.Histograms {
+			handlers = append(handlers, handler)
+		}
+		sort.Strings(handlers)
+
+		var name string
+		name = "lnx801_http_request_duration_seconds"
+		WriteMetricHelp(&buf, name)
+		for _, handler = range handlers {
+			var histogram *Histogram
+			histogram = METRICS.Histograms[handler]
+
+			var cumulative uint64
+			var index int
+			var bucket float64
+			for index, bucket = range histogram.Buckets {
+				cumulative += histogram.Counts[index]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, MetricLabels(map[string]string{"handler": handler, "le": strconv.FormatFloat(bucket, 'g', -1, 64)}), cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, MetricLabels(map[string]string{"handler": handler, "le": "+Inf"}), histogram.Count)
+			fmt.Fprintf(&buf, "%s_sum%s %v\n", name, MetricLabels(map[string]string{"handler": handler}), histogram.Sum)
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, MetricLabels(map[string]string{"handler": handler}), histogram.Count)
+		}
+	}
+	METRICS.Unlock()
+
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	response.Write(buf.Bytes())
+}
+
+func ApiError(response http.ResponseWriter, code int, message string) {
+	Api(response, code, nil, map[string]interface{}{"error": message})
+}
+
+// ParseTimeParam accepts RFC3339 as well as the plain formats the dashboard
+// uses, the latter are read in loc
+func ParseTimeParam(value string, loc *time.Location) (time.Time, error) {
+	var err error
+
+	var layout string
+	for _, layout = range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		var output time.Time
+		output, err = time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return output, nil
+		}
+	}
+
+	var output time.Time
+	output, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return output, errors.New(fmt.Sprintf("invalid time %q, want RFC3339 or 2006-01-02 15:04:05", value))
+	}
+	return output, nil
+}
+
+func ParseLimit(values url.Values) (int, error) {
+	var err error
+
+	var limit int
+	limit = 100
+	if values.Get("limit") != "" {
+		limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil || limit < 1 || limit > 1000 {
+			return 0, errors.New("limit must be between 1 and 1000")
+		}
+	}
+	return limit, nil
+}
+
+// cursors are opaque to clients, they carry the sort key of the last row
+func EncodeCursor(key string, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d", key, id)))
+}
+
+func DecodeCursor(cursor string) (string, int64, error) {
+	var err error
+
+	var data []byte
+	data, err = base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, errors.New("invalid cursor")
+	}
+
+	var index int
+	index = strings.LastIndex(string(data), "|")
+	if index < 0 {
+		return "", 0, errors.New("invalid cursor")
+	}
+
+	var id int64
+	id, err = strconv.ParseInt(string(data[index+1:]), 10, 64)
+	if err != nil {
+		return "", 0, errors.New("invalid cursor")
+	}
+
+	return string(data[:index]), id, nil
+}
+
+func FormatApiTime(input time.Time) string {
+	return input.UTC().Format(time.RFC3339)
+}
+
+func ApiV1(response http.ResponseWriter, request *http.Request) {
+	var parts []string
+	parts = strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/v1"), "/"), "/")
+	log.Println("parts:", parts)
+
+	if len(parts) == 3 && parts[0] == "devices" && parts[2] == "meta" {
+		if request.Method != "GET" && request.Method != "PUT" && request.Method != "PATCH" && request.Method != "DELETE" {
+			ApiError(response, 405, "only GET, PUT, PATCH and DELETE are supported")
+			return
+		}
+		ApiV1DeviceMeta(response, request, parts[1])
+		return
+	}
+
+	if len(parts) == 3 && parts[0] == "devices" && parts[2] == "wake" {
+		if request.Method != "POST" {
+			ApiError(response, 405, "only POST is supported")
+			return
+		}
+		ApiV1Wake(response, request, parts[1])
+		return
+	}
+
+	if request.Method != "GET" {
+		ApiError(response, 405, "only GET is supported")
+		return
+	}
+
+	if len(parts) == 1 && parts[0] == "devices" {
+		ApiV1Devices(response, request)
+	} else if len(parts) == 2 && parts[0] == "devices" {
+		ApiV1Device(response, request, parts[1])
+	} else if len(parts) == 3 && parts[0] == "devices" && parts[2] == "heartbeats" {
+		ApiV1Heartbeats(response, request, parts[1])
+	} else if len(parts) == 3 && parts[0] == "devices" && parts[2] == "wakes" {
+		ApiV1Wakes(response, request, parts[1])
+	} else if len(parts) == 3 && parts[0] == "devices" && parts[2] == "ports" {
+		ApiV1Ports(response, request, parts[1])
+	} else if len(parts) == 3 && parts[0] == "devices" && parts[2] == "snmp" {
+		ApiV1Snmp(response, request, parts[1])
+	} else if len(parts) == 1 && parts[0] == "topology" {
+		ApiV1Topology(response, request)
+	} else if len(parts) == 1 && parts[0] == "events" {
+		ApiV1Events(response, request)
+	} else if len(parts) == 1 && parts[0] == "stats" {
+		ApiV1Stats(response, request)
+	} else if len(parts) == 2 && parts[0] == "export" {
+		Export(response, request)
+	} else if len(parts) == 1 && parts[0] == "openapi.json" {
+		ApiV1OpenApi(response, request)
+	} else {
+		ApiError(response, 404, "no such endpoint")
+	}
+}
+
+func ScanDevice(rows interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+	var err error
+
+	var id int64
+	var agent_id string
+	var ip string
+	var mac string
+	var name string
+	var heartbeat_time time.Time
+
+	err = rows.Scan(&id, &agent_id, &ip, &mac, &name, &heartbeat_time)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"id":             id,
+		"agent_id":       agent_id,
+		"ip":             ip,
+		"mac":            mac,
+		"name":           name,
+		"vendor":         Vendor(mac),
+		"heartbeat_time": FormatApiTime(heartbeat_time),
+		"online":         time.Since(heartbeat_time) <= OFFLINE_AFTER,
+	}, nil
+}
+
+func ApiV1Devices(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var limit int
+	limit, err = ParseLimit(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"1=1"}
+	if values.Get("agent") != "" {
+		conditions = append(conditions, "agent_id=?")
+		args = append(args, values.Get("agent"))
+	}
+	if values.Get("ip") != "" {
+		conditions = append(conditions, "ip=?")
+		args = append(args, values.Get("ip"))
+	}
+	if values.Get("mac") != "" {
+		conditions = append(conditions, "mac=?")
+		args = append(args, values.Get("mac"))
+	}
+	if values.Get("cursor") != "" {
+		var id int64
+		_, id, err = DecodeCursor(values.Get("cursor"))
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+		conditions = append(conditions, "id>?")
+		args = append(args, id)
+	}
+	args = append(args, limit+1)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = `SELECT id, agent_id, ip, mac, name, heartbeat_time FROM device WHERE %s ORDER BY id LIMIT ?`
+	query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, args...)
+	defer rows.Close()
+	Raise(err)
+
+	var devices []map[string]interface{}
+	devices = make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var device map[string]interface{}
+		device, err = ScanDevice(rows)
+		Raise(err)
+
+		devices = append(devices, device)
+	}
+	Raise(rows.Err())
+
+	var next_cursor string
+	if len(devices) > limit {
+		devices = devices[:limit]
+		next_cursor = EncodeCursor("", devices[limit-1]["id"].(int64))
+	}
+
+	Api(response, 200, devices, map[string]interface{}{"next_cursor": next_cursor})
+}
+
+func LoadDevice(db *sql.DB, id string) (map[string]interface{}, error) {
+	var err error
+
+	var id2 int64
+	id2, err = strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	var query string
+	query = `SELECT id, agent_id, ip, mac, name, heartbeat_time FROM device WHERE id=?`
+
+	return ScanDevice(db.QueryRow(query, id2))
+}
+
+func ApiV1Device(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	Api(response, 200, device)
+}
+
+var DEVICE_META_FIELDS = []string{"display_name", "owner", "location", "tags", "criticality", "notes"}
+var CRITICALITIES = []string{"low", "normal", "high", "critical"}
+
+var TAG_PATTERN = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+// NormalizeTags lowercases, dedupes and sorts a comma separated tag list
+func NormalizeTags(value string) (string, error) {
+	var tags []string
+	var seen map[string]bool
+	seen = make(map[string]bool)
+
+	var tag string
+	for _, tag = range strings.Split(value, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !TAG_PATTERN.MatchString(tag) {
+			return "", errors.New(fmt.Sprintf("invalid tag %q, use up to 32 of a-z 0-9 _ . -", tag))
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return strings.Join(tags, ","), nil
+}
+
+// ParseDeviceMeta validates user input, fields that are missing become empty
+func ParseDeviceMeta(input map[string]string) (map[string]string, error) {
+	var err error
+
+	var meta map[string]string
+	meta = make(map[string]string)
+
+	var field string
+	for _, field = range DEVICE_META_FIELDS {
+		var value string
+		value = strings.TrimSpace(input[field])
+
+		var max int
+		max = 100
+		if field == "notes" {
+			max = 4000
+		}
+		if len(value) > max {
+			return nil, errors.New(fmt.Sprintf("%s must be at most %d bytes", field, max))
+		}
+
+		if field == "tags" {
+			value, err = NormalizeTags(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if field == "criticality" && value != "" {
+			var ok bool
+			var item string
+			for _, item = range CRITICALITIES {
+				ok = ok || item == value
+			}
+			if !ok {
+				return nil, errors.New("criticality must be one of " + strings.Join(CRITICALITIES, ", "))
+			}
+		}
+
+		meta[field] = value
+	}
+
+	return meta, nil
+}
+
+func LoadDeviceMeta(db *sql.DB, device_id int64) map[string]interface{} {
+	var err error
+
+	var meta map[string]interface{}
+	meta = map[string]interface{}{"device_id": device_id, "update_user": "", "update_time": nil}
+
+	var values []string
+	values = make([]string, len(DEVICE_META_FIELDS))
+
+	var targets []interface{}
+	var index int
+	for index = range DEVICE_META_FIELDS {
+		targets = append(targets, &values[index])
+	}
+
+	var update_user string
+	var update_time time.Time
+	targets = append(targets, &update_user, &update_time)
+
+	var query string
+	query = `SELECT %s, update_user, update_time FROM device_meta WHERE device_id=?`
+	query = fmt.Sprintf(query, strings.Join(DEVICE_META_FIELDS, ", "))
+
+	err = db.QueryRow(query, device_id).Scan(targets...)
+	if err != sql.ErrNoRows {
+		Raise(err)
+		meta["update_user"] = update_user
+		meta["update_time"] = FormatApiTime(update_time)
+	}
+
+	var field string
+	for index, field = range DEVICE_META_FIELDS {
+		if field == "tags" {
+			meta[field] = SplitTags(values[index])
+		} else {
+			meta[field] = values[index]
+		}
+	}
+
+	return meta
+}
+
+func SplitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+
+func SaveDeviceMeta(db *sql.DB, device_id int64, meta map[string]string, update_user string) {
+	var err error
+
+	var args []interface{}
+	args = append(args, device_id)
+
+	var updates []string
+	var field string
+	for _, field = range DEVICE_META_FIELDS {
+		args = append(args, meta[field])
+		updates = append(updates, field+"=excluded."+field)
+	}
+	args = append(args, update_user, DbTime(time.Now()))
+
+	var query string
+	query = `
+		INSERT INTO device_meta (device_id, %s, update_user, update_time)
+		VALUES (?%s,?,?)
+		ON CONFLICT (device_id) DO UPDATE SET %s, update_user=excluded.update_user, update_time=excluded.update_time
+	`
+	query = fmt.Sprintf(query, strings.Join(DEVICE_META_FIELDS, ", "), strings.Repeat(",?", len(DEVICE_META_FIELDS)), strings.Join(updates, ", "))
+
+	_, err = db.Exec(query, args...)
+	Raise(err)
+
+	log.Println("device meta saved:", device_id, update_user)
+}
+
+// ApiV1DeviceMeta reads and writes the annotations of a device. PUT replaces
+// all of them, PATCH only the fields given, tags may be a list or a string.
+func ApiV1DeviceMeta(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	var device_id int64
+	device_id = device["id"].(int64)
+
+	if request.Method == "DELETE" {
+		_, err = db.Exec(`DELETE FROM device_meta WHERE device_id=?`, device_id)
+		Raise(err)
+	} else if request.Method == "PUT" || request.Method == "PATCH" {
+		var body map[string]interface{}
+		err = json.NewDecoder(io.LimitReader(request.Body, 64*1024)).Decode(&body)
+		if err != nil {
+			ApiError(response, 400, "body must be a json object")
+			return
+		}
+
+		var input map[string]string
+		input = make(map[string]string)
+		if request.Method == "PATCH" {
+			var current map[string]interface{}
+			current = LoadDeviceMeta(db, device_id)
+
+			var field string
+			for _, field = range DEVICE_META_FIELDS {
+				if field == "tags" {
+					input[field] = strings.Join(current[field].([]string), ",")
+				} else {
+					input[field] = current[field].(string)
+				}
+			}
+		}
+
+		var key string
+		var value interface{}
+		for key, value = range body {
+			var ok bool
+			var item string
+			for _, item = range DEVICE_META_FIELDS {
+				ok = ok || item == key
+			}
+			if !ok {
+				ApiError(response, 400, fmt.Sprintf("unknown field %q", key))
+				return
+			}
+
+			var list []interface{}
+			list, ok = value.([]interface{})
+			if ok && key == "tags" {
+				var tags []string
+				var tag interface{}
+				for _, tag = range list {
+					tags = append(tags, fmt.Sprint(tag))
+				}
+				value = strings.Join(tags, ",")
+			}
+
+			input[key], ok = value.(string)
+			if !ok {
+				ApiError(response, 400, fmt.Sprintf("%s must be a string", key))
+				return
+			}
+		}
+
+		var meta map[string]string
+		meta, err = ParseDeviceMeta(input)
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+
+		var token map[string]interface{}
+		token, _ = request.Context().Value(CONTEXT_TOKEN).(map[string]interface{})
+		SaveDeviceMeta(db, device_id, meta, "token:"+fmt.Sprint(token["name"]))
+	}
+
+	Api(response, 200, LoadDeviceMeta(db, device_id))
+}
+
+func ApiV1Wake(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	// the body is optional, {"via": "server"} overrides the agent
+	var body map[string]interface{}
+	body = make(map[string]interface{})
+	if request.ContentLength != 0 {
+		err = json.NewDecoder(io.LimitReader(request.Body, 64*1024)).Decode(&body)
+		if err != nil && err != io.EOF {
+			ApiError(response, 400, "body must be a json object")
+			return
+		}
+	}
+
+	var via string
+	var ok bool
+	via, ok = body["via"].(string)
+	if !ok && body["via"] != nil {
+		ApiError(response, 400, "via must be a string")
+		return
+	}
+
+	var token map[string]interface{}
+	token, _ = request.Context().Value(CONTEXT_TOKEN).(map[string]interface{})
+
+	var wake map[string]interface{}
+	wake, err = RequestWake(db, device, via, "token:"+fmt.Sprint(token["name"]))
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	Api(response, 202, wake)
+}
+
+func ApiV1Wakes(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var limit int
+	limit, err = ParseLimit(request.URL.Query())
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	Api(response, 200, LoadWakes(db, device["id"].(int64), limit))
+}
+
+func ApiV1Ports(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	Api(response, 200, LoadOpenPorts(db, device["id"].(int64)))
+}
+
+func ApiV1Snmp(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	Api(response, 200, LoadSnmp(db, device))
+}
+
+func ApiV1Topology(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var root_id int64
+	if request.URL.Query().Get("root") != "" {
+		root_id, err = strconv.ParseInt(request.URL.Query().Get("root"), 10, 64)
+		if err != nil {
+			ApiError(response, 400, "invalid root")
+			return
+		}
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	Api(response, 200, BuildTopology(db, root_id))
+}
+
+// TimeRange reads from and to, defaulting to the last 24 hours
+func TimeRange(values url.Values) (time.Time, time.Time, error) {
+	var err error
+
+	var now time.Time
+	now = time.Now()
+
+	var from time.Time
+	var to time.Time
+	from = now.Add(-24 * time.Hour)
+	to = now
+
+	if values.Get("from") != "" {
+		from, err = ParseTimeParam(values.Get("from"), time.Local)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if values.Get("to") != "" {
+		to, err = ParseTimeParam(values.Get("to"), time.Local)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+func ApiV1Heartbeats(response http.ResponseWriter, request *http.Request, id string) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var limit int
+	limit, err = ParseLimit(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var from time.Time
+	var to time.Time
+	from, to, err = TimeRange(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, id)
+	if err == sql.ErrNoRows {
+		ApiError(response, 404, "no such device")
+		return
+	}
+	Raise(err)
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"agent_id=?", "ip=?", "heartbeat_time>=?", "heartbeat_time<=?"}
+	args = []interface{}{device["agent_id"], device["ip"], DbTime(from), DbTime(to)}
+	if values.Get("cursor") != "" {
+		var key string
+		var id2 int64
+		key, id2, err = DecodeCursor(values.Get("cursor"))
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+		conditions = append(conditions, "(heartbeat_time<? OR (heartbeat_time=? AND id<?))")
+		args = append(args, key, key, id2)
+	}
+	args = append(args, limit+1)
+
+	var query string
+	query = `
+		SELECT id, heartbeat_time, mac, name, source, rtt_min, rtt_avg, rtt_max, jitter, loss, CAST(heartbeat_time AS TEXT)
+		FROM device_log
+		WHERE %s
+		ORDER BY heartbeat_time DESC, id DESC
+		LIMIT ?
+	`
+	query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, args...)
+	defer rows.Close()
+	Raise(err)
+
+	var heartbeats []map[string]interface{}
+	var keys []string
+	heartbeats = make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var id2 int64
+		var heartbeat_time time.Time
+		var mac string
+		var name string
+		var source string
+		var ping [5]sql.NullFloat64
+		var key string
+
+		err = rows.Scan(&id2, &heartbeat_time, &mac, &name, &source, &ping[0], &ping[1], &ping[2], &ping[3], &ping[4], &key)
+		Raise(err)
+
+		var heartbeat map[string]interface{}
+		heartbeat = map[string]interface{}{
+			"id":             id2,
+			"mac":            mac,
+			"name":           name,
+			"heartbeat_time": FormatApiTime(heartbeat_time),
+			"source":         source,
+			"ping":           nil,
+		}
+		if ping[1].Valid {
+			heartbeat["ping"] = map[string]interface{}{
+				"rtt_min": ping[0].Float64,
+				"rtt_avg": ping[1].Float64,
+				"rtt_max": ping[2].Float64,
+				"jitter":  ping[3].Float64,
+				"loss":    ping[4].Float64,
+			}
+		}
+		heartbeats = append(heartbeats, heartbeat)
+		keys = append(keys, key)
+	}
+	Raise(rows.Err())
+
+	var next_cursor string
+	if len(heartbeats) > limit {
+		heartbeats = heartbeats[:limit]
+		next_cursor = EncodeCursor(keys[limit-1], heartbeats[limit-1]["id"].(int64))
+	}
+
+	Api(response, 200, heartbeats, map[string]interface{}{"next_cursor": next_cursor})
+}
+
+func ApiV1Events(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var values url.Values
+	values = request.URL.Query()
+	log.Println("values:", values)
+
+	var limit int
+	limit, err = ParseLimit(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var from time.Time
+	var to time.Time
+	from, to, err = TimeRange(values)
+	if err != nil {
+		ApiError(response, 400, err.Error())
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	conditions = []string{"event_time>=?", "event_time<=?"}
+	args = []interface{}{DbTime(from), DbTime(to)}
+	if values.Get("type") != "" {
+		conditions = append(conditions, "type=?")
+		args = append(args, values.Get("type"))
+	}
+	if values.Get("agent") != "" {
+		conditions = append(conditions, "agent_id=?")
+		args = append(args, values.Get("agent"))
+	}
+	if values.Get("ip") != "" {
+		conditions = append(conditions, "ip=?")
+		args = append(args, values.Get("ip"))
+	}
+	if values.Get("cursor") != "" {
+		var key string
+		var id int64
+		key, id, err = DecodeCursor(values.Get("cursor"))
+		if err != nil {
+			ApiError(response, 400, err.Error())
+			return
+		}
+		conditions = append(conditions, "(event_time<? OR (event_time=? AND id<?))")
+		args = append(args, key, key, id)
+	}
+	args = append(args, limit+1)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = `
+		SELECT id, type, agent_id, ip, mac, name, message, event_time, CAST(event_time AS TEXT)
+		FROM event
+		WHERE %s
+		ORDER BY event_time DESC, id DESC
+		LIMIT ?
+	`
+	query = fmt.Sprintf(query, strings.Join(conditions, " AND "))
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, args...)
+	defer rows.Close()
+	Raise(err)
+
+	var events []map[string]interface{}
+	var keys []string
+	events = make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var id int64
+		var event_type string
+		var agent_id string
+		var ip string
+		var mac string
+		var name string
+		var message string
+		var event_time time.Time
+		var key string
+
+		err = rows.Scan(&id, &event_type, &agent_id, &ip, &mac, &name, &message, &event_time, &key)
+		Raise(err)
+
+		events = append(events, map[string]interface{}{
+			"id":         id,
+			"type":       event_type,
+			"agent_id":   agent_id,
+			"ip":         ip,
+			"mac":        mac,
+			"name":       name,
+			"message":    message,
+			"event_time": FormatApiTime(event_time),
+		})
+		keys = append(keys, key)
+	}
+	Raise(rows.Err())
+
+	var next_cursor string
+	if len(events) > limit {
+		events = events[:limit]
+		next_cursor = EncodeCursor(keys[limit-1], events[limit-1]["id"].(int64))
+	}
+
+	Api(response, 200, events, map[string]interface{}{"next_cursor": next_cursor})
+}
+
+func ApiV1Stats(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var now time.Time
+	now = time.Now()
+
+	var online_since string
+	var day_ago string
+	online_since = DbTime(now.Add(-OFFLINE_AFTER))
+	day_ago = DbTime(now.Add(-24 * time.Hour))
+
+	var devices int64
+	var online int64
+	var agents int64
+	var heartbeats int64
+	var events int64
+	var new_devices int64
+
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(heartbeat_time>=?), 0) FROM device`, online_since).Scan(&devices, &online)
+	Raise(err)
+	err = db.QueryRow(`SELECT COUNT(*) FROM agent`).Scan(&agents)
+	Raise(err)
+	err = db.QueryRow(`SELECT COUNT(*) FROM device_log WHERE heartbeat_time>=?`, day_ago).Scan(&heartbeats)
+	Raise(err)
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(type='new'), 0) FROM event WHERE event_time>=?`, day_ago).Scan(&events, &new_devices)
+	Raise(err)
+
+	Api(response, 200, map[string]interface{}{
+		"devices":        devices,
+		"online":         online,
+		"offline":        devices - online,
+		"agents":         agents,
+		"heartbeats_24h": heartbeats,
+		"events_24h":     events,
+		"new_24h":        new_devices,
+	})
+}
+
+// API_V1_ROUTES is the single description of /api/v1, the OpenAPI document is
+// generated from it
+var API_V1_ROUTES = []map[string]interface{}{
+	{
+		"path":    "/api/v1/devices",
+		"summary": "List devices",
+		"params":  []string{"agent", "ip", "mac", "limit", "cursor"},
+		"schema":  "DeviceList",
+	},
+	{
+		"path":    "/api/v1/devices/{id}",
+		"summary": "Get a device",
+		"params":  []string{"id"},
+		"schema":  "Device",
+	},
+	{
+		"path":    "/api/v1/devices/{id}/heartbeats",
+		"summary": "List heartbeats of a device, newest first",
+		"params":  []string{"id", "from", "to", "limit", "cursor"},
+		"schema":  "HeartbeatList",
+	},
+	{
+		"path":    "/api/v1/devices/{id}/meta",
+		"summary": "Annotations of a device, PUT replaces them, PATCH updates the fields given",
+		"params":  []string{"id"},
+		"schema":  "DeviceMeta",
+		"methods": []string{"get", "put", "patch", "delete"},
+	},
+	{
+		"path":    "/api/v1/devices/{id}/wake",
+		"summary": "Send a Wake-on-LAN packet, by the device's agent unless via is server",
+		"params":  []string{"id"},
+		"schema":  "Wake",
+		"methods": []string{"post"},
+	},
+	{
+		"path":    "/api/v1/devices/{id}/wakes",
+		"summary": "List wakes of a device, newest first",
+		"params":  []string{"id", "limit"},
+		"schema":  "WakeList",
+	},
+	{
+		"path":    "/api/v1/devices/{id}/ports",
+		"summary": "List TCP ports the device's agent found open at its last port scan",
+		"params":  []string{"id"},
+		"schema":  "OpenPortList",
+	},
+	{
+		"path":    "/api/v1/devices/{id}/snmp",
+		"summary": "What the device's agent read over SNMP, and the switch ports its mac was learned on",
+		"params":  []string{"id"},
+		"schema":  "Snmp",
+	},
+	{
+		"path":    "/api/v1/topology",
+		"summary": "Polled switches in trees linked by LLDP, with the macs each port has plugged in",
+		"params":  []string{"root"},
+		"schema":  "Topology",
+	},
+	{
+		"path":    "/api/v1/events",
+		"summary": "List device events (" + strings.Join(EVENT_TYPES, ", ") + "), newest first",
+		"params":  []string{"type", "agent", "ip", "from", "to", "limit", "cursor"},
+		"schema":  "EventList",
+	},
+	{
+		"path":    "/api/v1/stats",
+		"summary": "Summary counters",
+		"params":  []string{},
+		"schema":  "Stats",
+	},
+	{
+		"path":    "/api/v1/export/devices",
+		"summary": "Export devices as csv, ndjson or xlsx",
+		"params":  []string{"format", "agent", "ip", "mac", "from", "to", "tz"},
+		"schema":  "Export",
+	},
+	{
+		"path":    "/api/v1/export/logs",
+		"summary": "Export heartbeats as csv, ndjson or xlsx, oldest first",
+		"params":  []string{"format", "agent", "ip", "mac", "from", "to", "tz"},
+		"schema":  "Export",
+	},
+}
+
+var API_V1_PARAMS = map[string]map[string]interface{}{
+	"id":     {"in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+	"agent":  {"in": "query", "description": "Agent id", "schema": map[string]interface{}{"type": "string"}},
+	"ip":     {"in": "query", "schema": map[string]interface{}{"type": "string"}},
+	"mac":    {"in": "query", "schema": map[string]interface{}{"type": "string"}},
+	"type":   {"in": "query", "schema": map[string]interface{}{"type": "string", "enum": EVENT_TYPES}},
+	"from":   {"in": "query", "description": "RFC3339 or 2006-01-02 15:04:05 server local time, defaults to 24 hours ago", "schema": map[string]interface{}{"type": "string"}},
+	"to":     {"in": "query", "description": "RFC3339 or 2006-01-02 15:04:05 server local time, defaults to now", "schema": map[string]interface{}{"type": "string"}},
+	"limit":  {"in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}},
+	"root":   {"in": "query", "description": "Device id of the switch to start the tree at, defaults to the one with the most links", "schema": map[string]interface{}{"type": "integer"}},
+	"cursor": {"in": "query", "description": "next_cursor of the previous page", "schema": map[string]interface{}{"type": "string"}},
+	"format": {"in": "query", "schema": map[string]interface{}{"type": "string", "enum": []string{"csv", "ndjson", "xlsx"}, "default": "csv"}},
+	"tz":     {"in": "query", "description": "IANA time zone for plain from and to, exports are unbounded without from and to", "schema": map[string]interface{}{"type": "string"}},
+}
+
+func ApiV1Schemas() map[string]interface{} {
+	var object = func(properties map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	var ref = func(name string) map[string]interface{} {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	var envelope = func(data map[string]interface{}, paged bool) map[string]interface{} {
+		var properties map[string]interface{}
+		properties = map[string]interface{}{
+			"code": map[string]interface{}{"type": "integer"},
+			"msg":  map[string]interface{}{"type": "string"},
+			"data": data,
+		}
+		if paged {
+			properties["next_cursor"] = map[string]interface{}{"type": "string", "description": "empty on the last page"}
+		}
+		return object(properties)
+	}
+	var list = func(name string) map[string]interface{} {
+		return map[string]interface{}{"type": "array", "items": ref(name)}
+	}
+
+	var str = map[string]interface{}{"type": "string"}
+	var integer = map[string]interface{}{"type": "integer"}
+	var datetime = map[string]interface{}{"type": "string", "format": "date-time"}
+
+	return map[string]interface{}{
+		"Device": object(map[string]interface{}{
+			"id": integer, "agent_id": str, "ip": str, "mac": str, "name": str, "vendor": str,
+			"heartbeat_time": datetime, "online": map[string]interface{}{"type": "boolean"},
+		}),
+		"Heartbeat": object(map[string]interface{}{
+			"id": integer, "mac": str, "name": str, "heartbeat_time": datetime,
+			"source": map[string]interface{}{"type": "string", "description": "ping, arp, dhcp, mdns, or the import kind: dnsmasq, dhcpd, kea, routeros, openwrt, snmp; empty from older agents"},
+			"ping": map[string]interface{}{
+				"type":        "object",
+				"description": "round trip times and jitter in ms, loss in percent; null when the heartbeat was not a ping",
+				"properties": map[string]interface{}{
+					"rtt_min": map[string]interface{}{"type": "number"},
+					"rtt_avg": map[string]interface{}{"type": "number"},
+					"rtt_max": map[string]interface{}{"type": "number"},
+					"jitter":  map[string]interface{}{"type": "number"},
+					"loss":    map[string]interface{}{"type": "number"},
+				},
+			},
+		}),
+		"Event": object(map[string]interface{}{
+			"id": integer, "type": str, "agent_id": str, "ip": str, "mac": str, "name": str,
+			"message": str, "event_time": datetime,
+		}),
+		"DeviceMeta": object(map[string]interface{}{
+			"device_id": integer, "display_name": str, "owner": str, "location": str,
+			"tags":        map[string]interface{}{"type": "array", "items": str},
+			"criticality": map[string]interface{}{"type": "string", "enum": append([]string{""}, CRITICALITIES...)},
+			"notes":       str, "update_user": str, "update_time": datetime,
+		}),
+		"DeviceMetaInput": object(map[string]interface{}{
+			"display_name": str, "owner": str, "location": str,
+			"tags":        map[string]interface{}{"description": "list or comma separated string", "oneOf": []interface{}{str, map[string]interface{}{"type": "array", "items": str}}},
+			"criticality": map[string]interface{}{"type": "string", "enum": append([]string{""}, CRITICALITIES...)},
+			"notes":       str,
+		}),
+		"Wake": object(map[string]interface{}{
+			"id": integer, "device_id": integer, "agent_id": str, "ip": str, "mac": str,
+			"via":     map[string]interface{}{"type": "string", "enum": WAKE_VIAS},
+			"status":  map[string]interface{}{"type": "string", "enum": []string{"pending", "relayed", "sent", "failed", "online", "timeout"}},
+			"message": str, "request_user": str, "request_time": datetime,
+			"send_time":   map[string]interface{}{"type": "string", "format": "date-time", "description": "empty until sent"},
+			"online_time": map[string]interface{}{"type": "string", "format": "date-time", "description": "empty until online"},
+		}),
+		"WakeInput": object(map[string]interface{}{
+			"via": map[string]interface{}{"type": "string", "enum": WAKE_VIAS, "description": "defaults to agent when the device has one"},
+		}),
+		"OpenPort": object(map[string]interface{}{
+			"port": integer, "protocol": str, "service": str, "banner": str,
+			"tls_cn":     map[string]interface{}{"type": "string", "description": "certificate common name, TLS ports only"},
+			"tls_sans":   map[string]interface{}{"type": "string", "description": "certificate DNS and IP names, comma separated"},
+			"first_seen": datetime, "last_seen": datetime,
+		}),
+		"Snmp": object(map[string]interface{}{
+			"sys_name": str, "sys_descr": str, "sys_object_id": str,
+			"sys_uptime": map[string]interface{}{"type": "integer", "description": "seconds"},
+			"snmp_time":  map[string]interface{}{"type": "string", "format": "date-time", "description": "empty until polled"},
+			"interfaces": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+				"index": integer, "name": str, "descr": str, "alias": str, "type": integer,
+				"speed": map[string]interface{}{"type": "integer", "description": "bit/s"},
+				"mac":   str, "admin_status": str, "oper_status": str, "bridge_port": integer,
+				"macs": map[string]interface{}{"type": "integer", "description": "forwarding table entries on it"},
+			})},
+			"fdb": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+				"mac": str, "vendor": str, "port": integer, "if_index": integer, "if_name": str,
+				"vlan":       map[string]interface{}{"type": "integer", "description": "0 when the switch has no Q-BRIDGE-MIB"},
+				"first_seen": datetime, "last_seen": datetime,
+				"device_id": map[string]interface{}{"type": "integer", "description": "a device with this mac, 0 when unknown"},
+			})},
+			"lldp": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+				"local_port": integer, "local_port_name": str, "chassis_id": str, "port_id": str, "port_descr": str,
+				"sys_name": str, "mgmt_ip": str,
+				"device_id": map[string]interface{}{"type": "integer", "description": "the device the neighbor is, 0 when unknown"},
+			})},
+			"switch_ports": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+				"switch_id": integer, "ip": str, "name": str, "sys_name": str, "port": integer, "if_name": str, "alias": str,
+				"last_seen": datetime, "macs": integer,
+			})},
+		}),
+		"TopologySwitch": object(map[string]interface{}{
+			"id": integer, "ip": str, "name": str, "sys_name": str, "online": map[string]interface{}{"type": "boolean"},
+			"uplink": map[string]interface{}{"type": "string", "description": "the port LLDP heard the parent switch on, empty for a root"},
+			"ports": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+				"port": integer, "name": str, "alias": str, "oper_status": str,
+				"trunk":    map[string]interface{}{"type": "boolean", "description": "another switch is behind it"},
+				"switches": list("TopologySwitch"),
+				"macs": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+					"mac": str, "vendor": str, "vlan": integer,
+					"devices": map[string]interface{}{"type": "array", "items": object(map[string]interface{}{
+						"id": integer, "ip": str, "name": str, "online": map[string]interface{}{"type": "boolean"},
+					})},
+				})},
+			})},
+		}),
+		"Topology": object(map[string]interface{}{
+			"root_id":  integer,
+			"switches": list("TopologySwitch"),
+			"macs":     map[string]interface{}{"type": "integer", "description": "macs put on a port"},
+			"unknown":  map[string]interface{}{"type": "integer", "description": "of those, ones no device has"},
+		}),
+		"Stats": object(map[string]interface{}{
+			"devices": integer, "online": integer, "offline": integer, "agents": integer,
+			"heartbeats_24h": integer, "events_24h": integer, "new_24h": integer,
+		}),
+		"Error": object(map[string]interface{}{
+			"code": integer, "msg": str, "error": str,
+		}),
+		"DeviceList":    envelope(list("Device"), true),
+		"HeartbeatList": envelope(list("Heartbeat"), true),
+		"EventList":     envelope(list("Event"), true),
+		"DeviceOne":     envelope(ref("Device"), false),
+		"DeviceMetaOne": envelope(ref("DeviceMeta"), false),
+		"WakeList":      envelope(list("Wake"), false),
+		"WakeOne":       envelope(ref("Wake"), false),
+		"OpenPortList":  envelope(list("OpenPort"), false),
+		"SnmpOne":       envelope(ref("Snmp"), false),
+		"TopologyOne":   envelope(ref("Topology"), false),
+		"StatsOne":      envelope(ref("Stats"), false),
+	}
+}
+
+func ApiV1OpenApi(response http.ResponseWriter, request *http.Request) {
+	var paths map[string]interface{}
+	paths = make(map[string]interface{})
+
+	var route map[string]interface{}
+	for _, route = range API_V1_ROUTES {
+		var parameters []map[string]interface{}
+		parameters = make([]map[string]interface{}, 0)
+
+		var name string
+		for _, name = range route["params"].([]string) {
+			var parameter map[string]interface{}
+			parameter = map[string]interface{}{"name": name}
+
+			var key string
+			var value interface{}
+			for key, value = range API_V1_PARAMS[name] {
+				parameter[key] = value
+			}
+			parameters = append(parameters, parameter)
+		}
+
+		var schema string
+		schema = route["schema"].(string)
+		if !strings.HasSuffix(schema, "List") {
+			schema = schema + "One"
+		}
+
+		var content map[string]interface{}
+		content = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/" + schema}},
+		}
+		if route["schema"] == "Export" {
+			content = make(map[string]interface{})
+
+			var format map[string]string
+			for _, format = range EXPORT_FORMATS {
+				content[strings.Split(format["content_type"], ";")[0]] = map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}
+			}
+		}
+
+		var errors2 map[string]interface{}
+		errors2 = map[string]interface{}{
+			"description": "error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+			},
+		}
+
+		var methods []string
+		methods = []string{"get"}
+		if route["methods"] != nil {
+			methods = route["methods"].([]string)
+		}
+
+		var operations map[string]interface{}
+		operations = make(map[string]interface{})
+
+		var method string
+		for _, method = range methods {
+			var operation map[string]interface{}
+			operation = map[string]interface{}{
+				"summary":    route["summary"],
+				"parameters": parameters,
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "ok",
+						"content":     content,
+					},
+					"400": errors2,
+					"401": errors2,
+					"404": errors2,
+				},
+			}
+			if method == "post" {
+				operation["responses"].(map[string]interface{})["202"] = operation["responses"].(map[string]interface{})["200"]
+				delete(operation["responses"].(map[string]interface{}), "200")
+			}
+			if method == "put" || method == "patch" || method == "post" {
+				operation["requestBody"] = map[string]interface{}{
+					"required": method != "post",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/" + route["schema"].(string) + "Input"}},
+					},
+				}
+			}
+			operations[method] = operation
+		}
+
+		paths[route["path"].(string)] = operations
+	}
+
+	var document map[string]interface{}
+	document = map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "lnx801",
+			"version": SETTINGS.VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": ApiV1Schemas(),
+			"securitySchemes": map[string]interface{}{
+				"token":  map[string]interface{}{"type": "apiKey", "in": "header", "name": "token"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []map[string]interface{}{{"token": []string{}}, {"bearer": []string{}}},
+	}
+
+	var body []byte
+	var err error
+	body, err = json.MarshalIndent(document, "", "  ")
+	Raise(err)
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Write(body)
+}
+
+func WritePem(path string, block_type string, der []byte, mode os.FileMode) error {
+	var err error
+
+	var data []byte
+	data = pem.EncodeToMemory(&pem.Block{Type: block_type, Bytes: der})
+
+	err = ioutil.WriteFile(path, data, mode)
+	return err
+}
+
+func GenerateKey() (*ecdsa.PrivateKey, []byte, error) {
+	var err error
+
+	var key *ecdsa.PrivateKey
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var der []byte
+	der, err = x509.MarshalECPrivateKey(key)
+	return key, der, err
+}
+
+func NewSerialNumber() *big.Int {
+	var err error
+
+	var serial *big.Int
+	serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	Raise(err)
+
+	return serial
+}
+
+// LoadOrCreateCa reads ca.crt and ca.key from dir, creating a new self signed
+// CA there on first use
+func LoadOrCreateCa(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	var err error
+
+	var cert_path string
+	var key_path string
+	cert_path = filepath.Join(dir, "ca.crt")
+	key_path = filepath.Join(dir, "ca.key")
+
+	_, err = os.Stat(cert_path)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var der []byte
+		_, der, err = GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = WritePem(key_path, "EC PRIVATE KEY", der, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var key *ecdsa.PrivateKey
+		key, err = x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var template2 x509.Certificate
+		template2 = x509.Certificate{
+			SerialNumber:          NewSerialNumber(),
+			Subject:               pkix.Name{CommonName: "lnx801 CA"},
+			NotBefore:             time.Now().Add(-1 * time.Hour),
+			NotAfter:              time.Now().AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+
+		var cert_der []byte
+		cert_der, err = x509.CreateCertificate(rand.Reader, &template2, &template2, &key.PublicKey, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = WritePem(cert_path, "CERTIFICATE", cert_der, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		log.Println("created ca:", cert_path)
+	}
+
+	var pair tls.Certificate
+	pair, err = tls.LoadX509KeyPair(cert_path, key_path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *x509.Certificate
+	cert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key *ecdsa.PrivateKey
+	var ok bool
+	key, ok = pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("ca.key is not an ECDSA key")
+	}
+
+	return cert, key, nil
+}
+
+// IssueCert writes name.crt and name.key signed by the CA, usable both as a
+// server certificate for hosts and as an agent client certificate
+func IssueCert(dir string, ca_cert *x509.Certificate, ca_key *ecdsa.PrivateKey, name string, hosts []string) error {
+	var err error
+
+	var key *ecdsa.PrivateKey
+	var der []byte
+	key, der, err = GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	var template2 x509.Certificate
+	template2 = x509.Certificate{
+		SerialNumber: NewSerialNumber(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().AddDate(2, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	var host string
+	for _, host = range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		var ip net.IP
+		ip = net.ParseIP(host)
+		if ip != nil {
+			template2.IPAddresses = append(template2.IPAddresses, ip)
+		} else {
+			template2.DNSNames = append(template2.DNSNames, host)
+		}
+	}
+
+	var cert_der []byte
+	cert_der, err = x509.CreateCertificate(rand.Reader, &template2, ca_cert, &key.PublicKey, ca_key)
+	if err != nil {
+		return err
+	}
+
+	err = WritePem(filepath.Join(dir, name+".key"), "EC PRIVATE KEY", der, 0600)
+	if err != nil {
+		return err
+	}
+	err = WritePem(filepath.Join(dir, name+".crt"), "CERTIFICATE", cert_der, 0644)
+	return err
+}
+
+// TlsConfig verifies client certificates whenever one is given, the dashboard
+// and /login share the listener so -tls-client-auth=require is enforced per
+// route by MakeHandler
+func TlsConfig(client_ca string, client_auth string) (*tls.Config, error) {
+	var err error
+
+	var config *tls.Config
+	config = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if client_ca == "" {
+		return config, nil
+	}
+
+	var data []byte
+	data, err = ioutil.ReadFile(client_ca)
+	if err != nil {
+		return nil, err
+	}
+
+	var pool *x509.CertPool
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(fmt.Sprintf("no certificates found in %s", client_ca))
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	if client_auth != "require" && client_auth != "verify" {
+		return nil, errors.New(fmt.Sprintf("invalid client auth %q, want require or verify", client_auth))
+	}
+
+	return config, nil
+}
+
+func CreateTableDevice() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM device"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE device (
+				id               INTEGER PRIMARY KEY AUTOINCREMENT,
+				agent_id         VARCHAR(100)  NOT NULL DEFAULT "",
+				ip               VARCHAR(100)  NOT NULL,
+				mac              VARCHAR(100)  NOT NULL,
+				name             VARCHAR(100)  NOT NULL,
+				heartbeat_time   DATETIME      NOT NULL,
+				online           INTEGER       NOT NULL DEFAULT 1,
+				dhcp_fingerprint VARCHAR(1000) NOT NULL DEFAULT "",
+				vendor_class     VARCHAR(100)  NOT NULL DEFAULT "",
+				device_type      VARCHAR(100)  NOT NULL DEFAULT "",
+				os_family        VARCHAR(100)  NOT NULL DEFAULT "",
+				port_scan_time   DATETIME      NULL,
+				sys_name         VARCHAR(1000) NOT NULL DEFAULT "",
+				sys_descr        VARCHAR(1000) NOT NULL DEFAULT "",
+				sys_object_id    VARCHAR(1000) NOT NULL DEFAULT "",
+				sys_uptime       INTEGER       NOT NULL DEFAULT 0,
+				snmp_time        DATETIME      NULL,
+				source           VARCHAR(100)  NOT NULL DEFAULT "",
+				latency_alert    INTEGER       NOT NULL DEFAULT 0,
+				loss_alert       INTEGER       NOT NULL DEFAULT 0
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table device")
+	}
+}
+
+func CreateTableDeviceLog() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM device_log"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE device_log (
+					id             INTEGER PRIMARY KEY AUTOINCREMENT,
+					agent_id       VARCHAR(100) NOT NULL DEFAULT "",
+					ip             VARCHAR(100) NOT NULL,
+					mac            VARCHAR(100) NOT NULL,
+					name           VARCHAR(100) NOT NULL,
+					heartbeat_time DATETIME     NOT NULL,
+					source         VARCHAR(100) NOT NULL DEFAULT "",
+					rtt_min        REAL         NULL,
+					rtt_avg        REAL         NULL,
+					rtt_max        REAL         NULL,
+					jitter         REAL         NULL,
+					loss           REAL         NULL
+				)
+			`
+
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__device_log__heartbeat_time ON device_log (heartbeat_time)"
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX IF NOT EXISTS idx__device_log__agent_id__ip__heartbeat_time ON device_log (agent_id, ip, heartbeat_time)"
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		log.Println("created table device_log")
+	}
+}
+
+// ping_loss keeps the pings of a device that got no reply at all, apart from
+// device_log where every row is a sign of life
+func CreateTablePingLoss() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM ping_loss"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE ping_loss (
+					id         INTEGER PRIMARY KEY AUTOINCREMENT,
+					agent_id   VARCHAR(100) NOT NULL DEFAULT "",
+					ip         VARCHAR(100) NOT NULL,
+					probe_time DATETIME     NOT NULL,
+					sent       INTEGER      NOT NULL
+				)
+			`
+
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE UNIQUE INDEX idx__ping_loss__agent_id__ip__probe_time ON ping_loss (agent_id, ip, probe_time)"
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		log.Println("created table ping_loss")
+	}
+}
+
+func CreateTableAgent() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM agent"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE agent (
+				id            INTEGER PRIMARY KEY AUTOINCREMENT,
+				agent_id      VARCHAR(100)  NOT NULL UNIQUE,
+				hostname      VARCHAR(100)  NOT NULL,
+				version       VARCHAR(100)  NOT NULL,
+				cidrs         VARCHAR(1000) NOT NULL,
+				register_time DATETIME      NOT NULL,
+				report_time   DATETIME
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table agent")
+	}
+}
+
+func CreateTableApiToken() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM api_token"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE api_token (
+				id             INTEGER PRIMARY KEY AUTOINCREMENT,
+				name           VARCHAR(100) NOT NULL,
+				agent_id       VARCHAR(100) NOT NULL DEFAULT "",
+				token_hash     VARCHAR(100) NOT NULL UNIQUE,
+				scopes         VARCHAR(100) NOT NULL,
+				create_time    DATETIME     NOT NULL,
+				last_used_time DATETIME,
+				revoke_time    DATETIME
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table api_token")
+	}
+}
+
+func CreateTableUser() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM user"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE user (
+				id            INTEGER PRIMARY KEY AUTOINCREMENT,
+				username      VARCHAR(100) NOT NULL UNIQUE,
+				password_hash VARCHAR(200) NOT NULL,
+				role          VARCHAR(100) NOT NULL,
+				create_time   DATETIME     NOT NULL,
+				login_time    DATETIME
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table user")
+	}
+}
+
+func CreateTableSession() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM session"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE session (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				session_hash VARCHAR(100) NOT NULL UNIQUE,
+				user_id      INTEGER      NOT NULL,
+				csrf_token   VARCHAR(100) NOT NULL,
+				create_time  DATETIME     NOT NULL,
+				expire_time  DATETIME     NOT NULL
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table session")
+	}
+}
+
+func CreateTableEvent() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM event"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE event (
+					id         INTEGER PRIMARY KEY AUTOINCREMENT,
+					type       VARCHAR(100)  NOT NULL,
+					agent_id   VARCHAR(100)  NOT NULL,
+					ip         VARCHAR(100)  NOT NULL,
+					mac        VARCHAR(100)  NOT NULL,
+					name       VARCHAR(100)  NOT NULL,
+					message    VARCHAR(1000) NOT NULL,
+					event_time DATETIME      NOT NULL
+				)
+			`
+
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__event__event_time ON event (event_time)"
+			_, err = db.Exec(query2)
+			Raise(err)
+		}
+
+		log.Println("created table event")
+	}
+}
+
+func CreateTableDeviceMeta() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM device_meta"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE device_meta (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id    INTEGER       NOT NULL UNIQUE,
+				display_name VARCHAR(100)  NOT NULL DEFAULT "",
+				owner        VARCHAR(100)  NOT NULL DEFAULT "",
+				location     VARCHAR(100)  NOT NULL DEFAULT "",
+				tags         VARCHAR(1000) NOT NULL DEFAULT "",
+				criticality  VARCHAR(100)  NOT NULL DEFAULT "",
+				notes        TEXT          NOT NULL DEFAULT "",
+				update_user  VARCHAR(100)  NOT NULL DEFAULT "",
+				update_time  DATETIME      NOT NULL
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table device_meta")
+	}
+}
+
+func CreateTableDeviceGroup() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM device_group"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE device_group (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				name        VARCHAR(100)  NOT NULL UNIQUE,
+				description VARCHAR(1000) NOT NULL DEFAULT "",
+				cidrs       VARCHAR(1000) NOT NULL DEFAULT "",
+				vendor      VARCHAR(100)  NOT NULL DEFAULT "",
+				name_regex  VARCHAR(100)  NOT NULL DEFAULT "",
+				tag         VARCHAR(100)  NOT NULL DEFAULT "",
+				create_time DATETIME      NOT NULL,
+				update_time DATETIME      NOT NULL
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
 
-	if strings.HasSuffix(request.URL.Path, ".json") {
-		Api(response, 200, data)
-	} else {
-		var tpl *template.Template
-		if SETTINGS.DEBUG {
-			tpl, err = template.ParseFiles("template/distribution.html")
-		} else {
-			tpl, err = template.ParseFS(TEMPLATE, "template/distribution.html")
-		}
-		Skip(err)
-		tpl.Execute(response, data)
+		log.Println("created table device_group")
 	}
 }
 
-func Report(response http.ResponseWriter, request *http.Request) {
+func CreateTableDeviceGroupMember() {
 	var err error
 
-	var body []byte
-	body, err = ioutil.ReadAll(request.Body)
-	log.Println("body:", string(body))
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
 	Raise(err)
 
-	var data []map[string]interface{}
-	json.Unmarshal(body, &data)
+	var query string
+	query = "SELECT 1 FROM device_group_member"
 
-	log.Println("data:", data)
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-	if len(data) == 0 {
-		Api(response, 400)
-		return
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE device_group_member (
+				id        INTEGER PRIMARY KEY AUTOINCREMENT,
+				group_id  INTEGER NOT NULL,
+				device_id INTEGER NOT NULL,
+				UNIQUE (group_id, device_id)
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table device_group_member")
 	}
+}
+
+func CreateTableWake() {
+	var err error
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Raise(err)
 
-	var device map[string]interface{}
-	for _, device = range data {
-		log.Println("device:", device)
+	var query string
+	query = "SELECT 1 FROM wake"
 
-		var ip string
-		var mac string
-		var name string
-		var heartbeat_time string
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-		ip = device["ip"].(string)
-		mac = device["mac"].(string)
-		name = device["name"].(string)
-		heartbeat_time = device["heartbeat_time"].(string)
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE wake (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id    INTEGER       NOT NULL,
+				agent_id     VARCHAR(100)  NOT NULL DEFAULT "",
+				ip           VARCHAR(100)  NOT NULL,
+				mac          VARCHAR(100)  NOT NULL,
+				via          VARCHAR(100)  NOT NULL,
+				status       VARCHAR(100)  NOT NULL,
+				message      VARCHAR(1000) NOT NULL DEFAULT "",
+				request_user VARCHAR(100)  NOT NULL DEFAULT "",
+				request_time DATETIME      NOT NULL,
+				send_time    DATETIME      NULL,
+				online_time  DATETIME      NULL
+			)
+		`
 
-		// if ip != "192.168.18.107" {
-		// 	continue
-		// }
+		_, err = db.Exec(query2)
+		Raise(err)
 
 		{
-			var query string
-			query = `INSERT INTO device_log (ip, mac, name, heartbeat_time) VALUES (?,?,?,?)`
-			_, err = db.Exec(query, ip, mac, name, heartbeat_time)
+			var query2 string
+			query2 = "CREATE INDEX idx__wake__device_id ON wake (device_id)"
+			_, err = db.Exec(query2)
 			Raise(err)
 		}
 
-		var rows_affected int64
-		{
-			var query string
-			query = `UPDATE device set mac=?, name=?, heartbeat_time=? WHERE ip=?`
+		log.Println("created table wake")
+	}
+}
 
-			var result sql.Result
-			result, err = db.Exec(query, mac, name, heartbeat_time, ip)
+func CreateTableOpenPort() {
+	var err error
 
-			rows_affected, err = result.RowsAffected()
-			log.Println("rows_affected:", rows_affected)
-			Raise(err)
-		}
-		{
-			if rows_affected == 0 {
-				var query string
-				query = `INSERT INTO device (ip, mac, name, heartbeat_time) VALUES (?,?,?,?)`
-				_, err = db.Exec(query, ip, mac, name, heartbeat_time)
-				Raise(err)
-			}
-		}
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM open_port"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
 	}
+	Skip(err)
 
-	Api(response, 200)
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE open_port (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id  INTEGER       NOT NULL,
+				port       INTEGER       NOT NULL,
+				service    VARCHAR(100)  NOT NULL DEFAULT "",
+				banner     VARCHAR(1000) NOT NULL DEFAULT "",
+				tls_cn     VARCHAR(1000) NOT NULL DEFAULT "",
+				tls_sans   VARCHAR(1000) NOT NULL DEFAULT "",
+				first_seen DATETIME      NOT NULL,
+				last_seen  DATETIME      NOT NULL,
+				UNIQUE (device_id, port)
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
+		log.Println("created table open_port")
+	}
 }
 
-func CreateTableDevice() {
+func CreateTableDeviceInterface() {
 	var err error
 
 	var db *sql.DB
@@ -544,7 +8615,7 @@ func CreateTableDevice() {
 	Raise(err)
 
 	var query string
-	query = "SELECT 1 FROM device"
+	query = "SELECT 1 FROM device_interface"
 
 	var rows *sql.Rows
 	rows, err = db.Query(query)
@@ -556,23 +8627,31 @@ func CreateTableDevice() {
 	if rows == nil {
 		var query2 string
 		query2 = `
-			CREATE TABLE device (
-				id             INTEGER PRIMARY KEY AUTOINCREMENT,
-				ip             VARCHAR(100) NOT NULL,
-				mac            VARCHAR(100) NOT NULL,
-				name           VARCHAR(100) NOT NULL,
-				heartbeat_time DATETIME     NOT NULL
+			CREATE TABLE device_interface (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id    INTEGER       NOT NULL,
+				if_index     INTEGER       NOT NULL,
+				name         VARCHAR(1000) NOT NULL DEFAULT "",
+				descr        VARCHAR(1000) NOT NULL DEFAULT "",
+				alias        VARCHAR(1000) NOT NULL DEFAULT "",
+				type         INTEGER       NOT NULL DEFAULT 0,
+				speed        INTEGER       NOT NULL DEFAULT 0,
+				mac          VARCHAR(100)  NOT NULL DEFAULT "",
+				admin_status VARCHAR(100)  NOT NULL DEFAULT "",
+				oper_status  VARCHAR(100)  NOT NULL DEFAULT "",
+				bridge_port  INTEGER       NOT NULL DEFAULT 0,
+				UNIQUE (device_id, if_index)
 			)
 		`
 
 		_, err = db.Exec(query2)
 		Raise(err)
 
-		log.Println("created table device")
+		log.Println("created table device_interface")
 	}
 }
 
-func CreateTableDeviceLog() {
+func CreateTableFdbEntry() {
 	var err error
 
 	var db *sql.DB
@@ -581,8 +8660,7 @@ func CreateTableDeviceLog() {
 	Raise(err)
 
 	var query string
-	query = "SELECT 1 FROM device_log"
-	query = fmt.Sprintf(query)
+	query = "SELECT 1 FROM fdb_entry"
 
 	var rows *sql.Rows
 	rows, err = db.Query(query)
@@ -592,38 +8670,203 @@ func CreateTableDeviceLog() {
 	Skip(err)
 
 	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE fdb_entry (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id  INTEGER      NOT NULL,
+				mac        VARCHAR(100) NOT NULL,
+				port       INTEGER      NOT NULL,
+				if_index   INTEGER      NOT NULL DEFAULT 0,
+				vlan       INTEGER      NOT NULL DEFAULT 0,
+				first_seen DATETIME     NOT NULL,
+				last_seen  DATETIME     NOT NULL,
+				UNIQUE (device_id, mac)
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
 		{
 			var query2 string
-			query2 = `
-				CREATE TABLE device_log (
-					id             INTEGER PRIMARY KEY AUTOINCREMENT,
-					ip             VARCHAR(100) NOT NULL,
-					mac            VARCHAR(100) NOT NULL,
-					name           VARCHAR(100) NOT NULL,
-					heartbeat_time DATETIME     NOT NULL
-				)
-			`
-			query2 = fmt.Sprintf(query2)
-
+			query2 = "CREATE INDEX idx__fdb_entry__mac ON fdb_entry (mac)"
 			_, err = db.Exec(query2)
 			Raise(err)
 		}
 
+		log.Println("created table fdb_entry")
+	}
+}
+
+func CreateTableLldpNeighbor() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	var query string
+	query = "SELECT 1 FROM lldp_neighbor"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		query2 = `
+			CREATE TABLE lldp_neighbor (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id       INTEGER       NOT NULL,
+				local_port      INTEGER       NOT NULL,
+				local_port_name VARCHAR(1000) NOT NULL DEFAULT "",
+				chassis_id      VARCHAR(1000) NOT NULL DEFAULT "",
+				port_id         VARCHAR(1000) NOT NULL DEFAULT "",
+				port_descr      VARCHAR(1000) NOT NULL DEFAULT "",
+				sys_name        VARCHAR(1000) NOT NULL DEFAULT "",
+				mgmt_ip         VARCHAR(100)  NOT NULL DEFAULT ""
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Raise(err)
+
 		{
 			var query2 string
-			query2 = "CREATE INDEX idx__device_log__heartbeat_time ON device_log (heartbeat_time)"
-			query2 = fmt.Sprintf(query2)
+			query2 = "CREATE INDEX idx__lldp_neighbor__device_id ON lldp_neighbor (device_id)"
 			_, err = db.Exec(query2)
 			Raise(err)
 		}
 
-		log.Println("created table device_log")
+		log.Println("created table lldp_neighbor")
+	}
+}
+
+// MigrateUtc rewrites the zoneless local times written by earlier versions as
+// UTC, applying the offset of loc in effect at each row's own time. It parses
+// them exactly like ParseHeartbeatTime does, SQLite's 'utc' modifier picks a
+// different instant for the hour skipped when DST starts, and a spooled old
+// report replayed after the migration must land on the row it duplicates. It
+// refuses to run twice.
+func MigrateUtc(loc *time.Location) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Raise(err)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS migration (name VARCHAR(100) PRIMARY KEY, apply_time DATETIME NOT NULL)`)
+	Raise(err)
+
+	var applied int64
+	err = db.QueryRow(`SELECT COUNT(*) FROM migration WHERE name='utc'`).Scan(&applied)
+	Raise(err)
+	if applied != 0 {
+		Raise(errors.New("migration utc was already applied"))
+	}
+
+	var tx *sql.Tx
+	tx, err = db.Begin()
+	Raise(err)
+	defer tx.Rollback()
+
+	var columns [][]string
+	columns = [][]string{
+		{"device", "heartbeat_time"},
+		{"device_log", "heartbeat_time"},
+		{"agent", "register_time"},
+		{"agent", "report_time"},
+		{"api_token", "create_time"},
+		{"api_token", "last_used_time"},
+		{"api_token", "revoke_time"},
+		{"user", "create_time"},
+		{"user", "login_time"},
+		{"session", "create_time"},
+		{"session", "expire_time"},
+		{"event", "event_time"},
+	}
+
+	var column []string
+	for _, column = range columns {
+		var query string
+		query = fmt.Sprintf(`SELECT rowid, CAST(%s AS TEXT) FROM %s WHERE rowid>? AND %s IS NOT NULL ORDER BY rowid LIMIT 1000`, column[1], column[0], column[1])
+
+		var query2 string
+		query2 = fmt.Sprintf(`UPDATE %s SET %s=? WHERE rowid=?`, column[0], column[1])
+
+		// in batches by rowid, the updates change indexed columns
+		var rows_affected int64
+		var last int64
+		for {
+			var batch []map[string]interface{}
+			{
+				var rows *sql.Rows
+				rows, err = tx.Query(query, last)
+				Raise(err)
+
+				for rows.Next() {
+					var rowid int64
+					var value string
+					err = rows.Scan(&rowid, &value)
+					Raise(err)
+					batch = append(batch, map[string]interface{}{"rowid": rowid, "value": value})
+				}
+				Raise(rows.Err())
+				rows.Close()
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			var row map[string]interface{}
+			for _, row = range batch {
+				last = row["rowid"].(int64)
+
+				var local time.Time
+				local, err = time.ParseInLocation("2006-01-02 15:04:05", row["value"].(string), loc)
+				if err != nil {
+					log.Println("not migrated:", column[0], column[1], row["rowid"], err)
+					continue
+				}
+
+				_, err = tx.Exec(query2, DbTime(local), row["rowid"])
+				Raise(err)
+				rows_affected++
+			}
+		}
+		log.Println("migrated:", column[0], column[1], rows_affected)
 	}
+
+	_, err = tx.Exec(`INSERT INTO migration (name, apply_time) VALUES ('utc', ?)`, DbTime(time.Now()))
+	Raise(err)
+
+	err = tx.Commit()
+	Raise(err)
 }
 
 func InitDb() {
 	CreateTableDevice()
 	CreateTableDeviceLog()
+	CreateTablePingLoss()
+	CreateTableAgent()
+	CreateTableApiToken()
+	CreateTableUser()
+	CreateTableSession()
+	CreateTableEvent()
+	CreateTableDeviceMeta()
+	CreateTableDeviceGroup()
+	CreateTableDeviceGroupMember()
+	CreateTableWake()
+	CreateTableOpenPort()
+	CreateTableDeviceInterface()
+	CreateTableFdbEntry()
+	CreateTableLldpNeighbor()
 }
 
 func main() {
@@ -636,10 +8879,56 @@ func main() {
 	var host string
 	var port int
 	var debug bool
+	var scan_interval time.Duration
+	var token_create string
+	var token_scopes string
+	var token_agent string
+	var token_list bool
+	var token_revoke int64
+	var token_rotate int64
+	var tls_cert string
+	var tls_key string
+	var tls_client_ca string
+	var tls_client_auth string
+	var gen_ca bool
+	var gen_dir string
+	var gen_name string
+	var gen_hosts string
+	var user_create string
+	var user_role string
+	var migrate_utc bool
+	var oui string
+	var dhcp_fingerprints string
+	var import_dhcp_log string
+	var latency_threshold float64
+	var loss_threshold float64
 	// flag.StringVar(&host, "host", "0.0.0.0", "Host")
 	flag.StringVar(&host, "host", "127.0.0.1", "Host")
 	flag.IntVar(&port, "port", 801, "Port")
 	flag.BoolVar(&debug, "debug", false, "Debug")
+	flag.DurationVar(&scan_interval, "scan-interval", SETTINGS.SCAN_INTERVAL, "Interval agents scan at, heartbeat gaps longer than two intervals count as outages")
+	flag.StringVar(&token_create, "token-create", "", "Create an api token with this name and exit")
+	flag.StringVar(&token_scopes, "token-scopes", "report", "Comma separated scopes for -token-create: report, read, admin")
+	flag.StringVar(&token_agent, "token-agent", "", "Bind the token from -token-create to this agent id")
+	flag.BoolVar(&token_list, "token-list", false, "List api tokens and exit")
+	flag.Int64Var(&token_revoke, "token-revoke", 0, "Revoke the api token with this id and exit")
+	flag.Int64Var(&token_rotate, "token-rotate", 0, "Replace the api token with this id by a new one and exit")
+	flag.StringVar(&tls_cert, "tls-cert", "", "Serve HTTPS with this certificate")
+	flag.StringVar(&tls_key, "tls-key", "", "Private key for -tls-cert")
+	flag.StringVar(&tls_client_ca, "tls-client-ca", "", "Verify client certificates against this CA")
+	flag.StringVar(&tls_client_auth, "tls-client-auth", "require", "With -tls-client-ca: require on the agent routes /api/report and /api/register, or verify only if given")
+	flag.BoolVar(&gen_ca, "gen-ca", false, "Create a CA in -gen-dir if missing, issue a certificate for -gen-name and exit")
+	flag.StringVar(&gen_dir, "gen-dir", "certs", "Directory for -gen-ca")
+	flag.StringVar(&gen_name, "gen-name", "", "Name of the certificate issued by -gen-ca, e.g. the agent id or server")
+	flag.StringVar(&gen_hosts, "gen-hosts", "", "Comma separated DNS names and IPs for a server certificate")
+	flag.StringVar(&user_create, "user-create", "", "Create a dashboard user with this name, read the password from stdin and exit")
+	flag.StringVar(&user_role, "user-role", "admin", "Role for -user-create: viewer or admin")
+	flag.BoolVar(&migrate_utc, "migrate-utc", false, "Convert times stored by versions before UTC storage to UTC once and exit")
+	flag.StringVar(&oui, "oui", "", "IEEE oui.txt for vendor names, a small built in subset is used without it")
+	flag.StringVar(&dhcp_fingerprints, "dhcp-fingerprints", "", "Extra DHCP fingerprint rules, checked before the built in ones, see data/dhcp_fingerprints.txt")
+	flag.StringVar(&import_dhcp_log, "import-dhcp-log", "", "Fingerprint devices from a dnsmasq log written with --log-dhcp and exit")
+	flag.Float64Var(&latency_threshold, "latency-threshold", SETTINGS.LATENCY_THRESHOLD, "Average round trip time in ms over the last pings that raises a latency_high event, 0 for off")
+	flag.Float64Var(&loss_threshold, "loss-threshold", SETTINGS.LOSS_THRESHOLD, "Average packet loss in percent over the last pings that raises a loss_high event, 0 for off")
 	flag.Parse()
 	log.Println("host:", host)
 	log.Println("port:", port)
@@ -651,10 +8940,100 @@ func main() {
 	log.Println("address:", address)
 
 	SETTINGS.DEBUG = debug
+	SETTINGS.SCAN_INTERVAL = scan_interval
+	SETTINGS.OUI = oui
+	SETTINGS.DHCP_FINGERPRINTS = dhcp_fingerprints
+	SETTINGS.LATENCY_THRESHOLD = latency_threshold
+	SETTINGS.LOSS_THRESHOLD = loss_threshold
 	log.Printf("SETTINGS: %+v\n", SETTINGS)
 
+	VENDORS = ParseOui(OUI_TXT)
+	if SETTINGS.OUI != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(SETTINGS.OUI)
+		Raise(err)
+		VENDORS = ParseOui(data)
+	}
+	log.Println("vendors:", len(VENDORS))
+
+	DHCP_FINGERPRINTS = ParseDhcpFingerprints(DHCP_FINGERPRINTS_TXT)
+	if SETTINGS.DHCP_FINGERPRINTS != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(SETTINGS.DHCP_FINGERPRINTS)
+		Raise(err)
+		DHCP_FINGERPRINTS = append(ParseDhcpFingerprints(data), DHCP_FINGERPRINTS...)
+	}
+	log.Println("dhcp fingerprints:", len(DHCP_FINGERPRINTS))
+
+	if gen_ca {
+		var ca_cert *x509.Certificate
+		var ca_key *ecdsa.PrivateKey
+		ca_cert, ca_key, err = LoadOrCreateCa(gen_dir)
+		Raise(err)
+
+		if gen_name != "" {
+			err = IssueCert(gen_dir, ca_cert, ca_key, gen_name, strings.Split(gen_hosts, ","))
+			Raise(err)
+			fmt.Printf("issued: %s %s\n", filepath.Join(gen_dir, gen_name+".crt"), filepath.Join(gen_dir, gen_name+".key"))
+		}
+		os.Exit(0)
+	}
+
 	InitDb()
 
+	if migrate_utc {
+		MigrateUtc(time.Local)
+		fmt.Println("migrated: utc")
+		os.Exit(0)
+	}
+
+	if import_dhcp_log != "" {
+		err = ImportDhcpLog(import_dhcp_log)
+		Raise(err)
+		fmt.Println("imported:", import_dhcp_log)
+		os.Exit(0)
+	}
+
+	if user_create != "" {
+		fmt.Fprint(os.Stderr, "password: ")
+
+		var password string
+		password, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			Raise(err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+
+		var id int64
+		id, err = CreateUser(user_create, password, user_role)
+		Raise(err)
+		fmt.Printf("id: %d\nuser: %s\nrole: %s\n", id, user_create, user_role)
+		os.Exit(0)
+	}
+
+	if token_create != "" || token_list || token_revoke != 0 || token_rotate != 0 {
+		var id int64
+		var token string
+		if token_create != "" {
+			id, token, err = CreateToken(token_create, token_scopes, token_agent)
+			Raise(err)
+			fmt.Printf("id: %d\ntoken: %s\n", id, token)
+		} else if token_list {
+			ListTokens()
+		} else if token_revoke != 0 {
+			err = RevokeToken(token_revoke)
+			Raise(err)
+			fmt.Printf("revoked: %d\n", token_revoke)
+		} else {
+			id, token, err = RotateToken(token_rotate)
+			Raise(err)
+			fmt.Printf("revoked: %d\nid: %d\ntoken: %s\n", token_rotate, id, token)
+		}
+		os.Exit(0)
+	}
+
+	go WatchDevices()
+
 	http.HandleFunc("/", MakeHandler(Index))
 	http.HandleFunc("/index", MakeHandler(Index))
 	http.HandleFunc("/index.html", MakeHandler(Index))
@@ -662,11 +9041,41 @@ func main() {
 	http.HandleFunc("/detail", MakeHandler(Detail))
 	http.HandleFunc("/detail.html", MakeHandler(Detail))
 	http.HandleFunc("/detail.json", MakeHandler(Detail))
+	http.HandleFunc("/device", MakeHandler(Device))
+	http.HandleFunc("/device.html", MakeHandler(Device))
+	http.HandleFunc("/device.json", MakeHandler(Device))
+	http.HandleFunc("/device/meta", MakeHandler(DeviceMetaForm))
+	http.HandleFunc("/device/wake", MakeHandler(WakeForm))
+	http.HandleFunc("/groups", MakeHandler(Groups))
+	http.HandleFunc("/groups.html", MakeHandler(Groups))
+	http.HandleFunc("/groups.json", MakeHandler(Groups))
+	http.HandleFunc("/group", MakeHandler(Group))
+	http.HandleFunc("/group.html", MakeHandler(Group))
+	http.HandleFunc("/group.json", MakeHandler(Group))
+	http.HandleFunc("/group/edit", MakeHandler(GroupForm))
 	http.HandleFunc("/distribution", MakeHandler(Distribution))
 	http.HandleFunc("/distribution.html", MakeHandler(Distribution))
 	http.HandleFunc("/distribution.json", MakeHandler(Distribution))
 	http.HandleFunc("/favicon.ico", MakeHandler(HttpStatusOk))
+	http.HandleFunc("/login", MakeHandler(Login))
+	http.HandleFunc("/logout", MakeHandler(Logout))
+	http.HandleFunc("/agents", MakeHandler(Agents))
+	http.HandleFunc("/agents.html", MakeHandler(Agents))
+	http.HandleFunc("/agents.json", MakeHandler(Agents))
+	http.HandleFunc("/topology", MakeHandler(Topology))
+	http.HandleFunc("/topology.html", MakeHandler(Topology))
+	http.HandleFunc("/topology.json", MakeHandler(Topology))
+	http.HandleFunc("/report", MakeHandler(Availabilities))
+	http.HandleFunc("/report.html", MakeHandler(Availabilities))
+	http.HandleFunc("/report.json", MakeHandler(Availabilities))
+	http.HandleFunc("/report.csv", MakeHandler(Availabilities))
+	http.HandleFunc("/export/devices", MakeHandler(Export))
+	http.HandleFunc("/export/logs", MakeHandler(Export))
+	http.HandleFunc("/events/stream", MakeHandler(EventStream))
+	http.HandleFunc("/metrics", MakeHandler(Metrics))
 	http.HandleFunc("/api/report", MakeHandler(Report))
+	http.HandleFunc("/api/register", MakeHandler(Register))
+	http.HandleFunc("/api/v1/", MakeHandler(ApiV1))
 
 	// var httpFileSystem http.FileSystem
 	// httpFileSystem = http.FS(STATIC)
@@ -674,7 +9083,19 @@ func main() {
 	// httpHandler = http.FileServer(httpFileSystem)
 	// http.Handle("/static/", httpHandler)
 
-	log.Printf("ListenAndServe: http://%v/\n", address)
-	err = http.ListenAndServe(address, nil)
-	Raise(err)
+	if tls_cert != "" {
+		var server *http.Server
+		server = &http.Server{Addr: address}
+		server.TLSConfig, err = TlsConfig(tls_client_ca, tls_client_auth)
+		Raise(err)
+		SETTINGS.TLS_CLIENT_REQUIRED = tls_client_ca != "" && tls_client_auth == "require"
+
+		log.Printf("ListenAndServeTLS: https://%v/\n", address)
+		err = server.ListenAndServeTLS(tls_cert, tls_key)
+		Raise(err)
+	} else {
+		log.Printf("ListenAndServe: http://%v/\n", address)
+		err = http.ListenAndServe(address, nil)
+		Raise(err)
+	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testLegacyHash is a password hash the way it was stored before bcrypt
+func testLegacyHash(t *testing.T, password string) string {
+	var salt []byte
+	salt = []byte("0123456789abcdef")
+
+	var key []byte
+	var err error
+	key, err = pbkdf2.Key(sha256.New, password, salt, 1000, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", 1000, hex.EncodeToString(salt), hex.EncodeToString(key))
+}
+
+func TestCheckPassword(t *testing.T) {
+	var err error
+
+	var password_hash string
+	password_hash, err = HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(password_hash, "$2a$12$") {
+		t.Fatalf("not a bcrypt hash: %s", password_hash)
+	}
+
+	var cases []map[string]interface{}
+	cases = []map[string]interface{}{
+		{"hash": password_hash, "password": "correct horse", "want": true},
+		{"hash": password_hash, "password": "correct horse ", "want": false},
+		{"hash": testLegacyHash(t, "correct horse"), "password": "correct horse", "want": true},
+		{"hash": testLegacyHash(t, "correct horse"), "password": "battery", "want": false},
+		{"hash": "pbkdf2-sha256$1000$zz$00", "password": "correct horse", "want": false},
+		{"hash": "", "password": "", "want": false},
+	}
+
+	var item map[string]interface{}
+	for _, item = range cases {
+		if CheckPassword(item["password"].(string), item["hash"].(string)) != item["want"] {
+			t.Errorf("%q against %q: want %v", item["password"], item["hash"], item["want"])
+		}
+	}
+}
+
+// testLogin posts the login form with the given csrf cookie and field
+func testLogin(t *testing.T, cookie string, csrf string, password string) *httptest.ResponseRecorder {
+	var form url.Values
+	form = url.Values{"username": {"admin"}, "password": {password}, "csrf": {csrf}}
+
+	var request *http.Request
+	request = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		request.AddCookie(&http.Cookie{Name: LOGIN_CSRF_COOKIE, Value: cookie})
+	}
+
+	var recorder *httptest.ResponseRecorder
+	recorder = httptest.NewRecorder()
+	Login(recorder, request)
+	return recorder
+}
+
+func TestLogin(t *testing.T) {
+	var db *sql.DB
+	db = testDb(t)
+
+	var err error
+	_, err = CreateUser("admin", "correct horse", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an account from before bcrypt
+	_, err = db.Exec(`UPDATE user SET password_hash=? WHERE username='admin'`, testLegacyHash(t, "correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the form carries the token of the cookie it sets
+	var recorder *httptest.ResponseRecorder
+	recorder = httptest.NewRecorder()
+	Login(recorder, httptest.NewRequest("GET", "/login", nil))
+
+	var csrf string
+	var cookie *http.Cookie
+	for _, cookie = range recorder.Result().Cookies() {
+		if cookie.Name == LOGIN_CSRF_COOKIE {
+			csrf = cookie.Value
+		}
+	}
+	if csrf == "" || !strings.Contains(recorder.Body.String(), `name="csrf" value="`+csrf+`"`) {
+		t.Fatalf("no csrf token in the form: %q", csrf)
+	}
+
+	var cases []map[string]interface{}
+	cases = []map[string]interface{}{
+		{"cookie": "", "csrf": "", "password": "correct horse", "want": 403},
+		{"cookie": "", "csrf": csrf, "password": "correct horse", "want": 403},
+		{"cookie": csrf, "csrf": "", "password": "correct horse", "want": 403},
+		{"cookie": csrf, "csrf": "forged", "password": "correct horse", "want": 403},
+		{"cookie": csrf, "csrf": csrf, "password": "battery", "want": 401},
+	}
+
+	var item map[string]interface{}
+	for _, item = range cases {
+		recorder = testLogin(t, item["cookie"].(string), item["csrf"].(string), item["password"].(string))
+		if recorder.Code != item["want"] {
+			t.Fatalf("%v: got %d", item, recorder.Code)
+		}
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM session`) != 0 {
+		t.Fatal("session created without a valid login")
+	}
+
+	recorder = testLogin(t, csrf, csrf, "correct horse")
+	if recorder.Code != 303 || testCount(t, db, `SELECT COUNT(*) FROM session`) != 1 {
+		t.Fatalf("login got %d", recorder.Code)
+	}
+
+	// the legacy hash was replaced on the way
+	var password_hash string
+	err = db.QueryRow(`SELECT password_hash FROM user WHERE username='admin'`).Scan(&password_hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(password_hash, "$2a$") || !CheckPassword("correct horse", password_hash) {
+		t.Fatalf("legacy hash not replaced: %s", password_hash)
+	}
+}
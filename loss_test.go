@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPing reports one ping of 10.0.0.1 from minutes ago, lost when rtt is
+// negative
+func testPing(t *testing.T, minutes int, rtt float64) int {
+	var heartbeat_time string
+	heartbeat_time = time.Now().UTC().Add(time.Duration(-minutes) * time.Minute).Format("2006-01-02 15:04:05")
+
+	var ping string
+	ping = fmt.Sprintf(`{"sent":3,"received":3,"loss":0,"rtt_min":%v,"rtt_avg":%v,"rtt_max":%v,"jitter":0}`, rtt, rtt, rtt)
+	if rtt < 0 {
+		ping = `{"sent":3,"received":0,"loss":100,"rtt_min":null,"rtt_avg":null,"rtt_max":null,"jitter":null}`
+	}
+	return testReport(t, `[{"agent_id":"a1","ip":"10.0.0.1","mac":"","name":"","source":"ping","heartbeat_time":"`+heartbeat_time+`","ping":`+ping+`}]`)
+}
+
+func TestPingLoss(t *testing.T) {
+	var db *sql.DB
+	db = testDb(t)
+
+	var latency_threshold float64
+	var loss_threshold float64
+	latency_threshold = SETTINGS.LATENCY_THRESHOLD
+	loss_threshold = SETTINGS.LOSS_THRESHOLD
+	SETTINGS.LATENCY_THRESHOLD = 100
+	SETTINGS.LOSS_THRESHOLD = 10
+	t.Cleanup(func() {
+		SETTINGS.LATENCY_THRESHOLD = latency_threshold
+		SETTINGS.LOSS_THRESHOLD = loss_threshold
+	})
+
+	// two replies, then the device stops answering
+	var minutes int
+	var index int
+	for index, minutes = range []int{10, 9, 8, 7, 6} {
+		var rtt float64
+		rtt = 2
+		if index >= 2 {
+			rtt = -1
+		}
+		if testPing(t, minutes, rtt) != 200 {
+			t.Fatalf("ping %d minutes ago rejected", minutes)
+		}
+	}
+
+	if testCount(t, db, `SELECT COUNT(*) FROM device_log`) != 2 {
+		t.Fatal("lost pings were logged as heartbeats")
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM ping_loss`) != 3 {
+		t.Fatal("lost pings not kept")
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM device WHERE heartbeat_time=?`, time.Now().UTC().Add(-9*time.Minute).Format("2006-01-02 15:04:05")) != 1 {
+		t.Fatal("a lost ping moved the heartbeat")
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM event WHERE type='loss_high' AND message LIKE 'average packet loss 60.0% over the last 5 pings%'`) != 1 {
+		t.Fatal("no loss_high for 3 lost pings out of 5")
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM event WHERE type LIKE 'latency_%'`) != 0 {
+		t.Fatal("latency judged on lost pings")
+	}
+
+	// a replayed lost ping is stored once
+	if testPing(t, 6, -1) != 200 || testCount(t, db, `SELECT COUNT(*) FROM ping_loss`) != 3 {
+		t.Fatal("replayed lost ping stored twice")
+	}
+
+	// the device page counts them too
+	var recorder *httptest.ResponseRecorder
+	recorder = httptest.NewRecorder()
+	Device(recorder, httptest.NewRequest("GET", "/device.json?id=1", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("device page got %d", recorder.Code)
+	}
+
+	var page struct {
+		Data struct {
+			Latency map[string]interface{} `json:"latency"`
+		} `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	if fmt.Sprint(page.Data.Latency["samples"], page.Data.Latency["probes"], page.Data.Latency["loss"], page.Data.Latency["lossy"]) != "2 5 60 3" {
+		t.Fatalf("latency summary %v", page.Data.Latency)
+	}
+
+	recorder = httptest.NewRecorder()
+	Device(recorder, httptest.NewRequest("GET", "/device?id=1", nil))
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), "<td>5</td>") {
+		t.Fatalf("device page got %d", recorder.Code)
+	}
+
+	// all pings lost, then the device answers again
+	for minutes = 5; minutes >= 4; minutes-- {
+		testPing(t, minutes, -1)
+	}
+	for minutes = 3; minutes >= 0; minutes-- {
+		testPing(t, minutes, 2)
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM event WHERE type='loss_high'`) != 1 {
+		t.Fatal("loss_high raised twice")
+	}
+	if testCount(t, db, `SELECT loss_alert FROM device`) != 1 {
+		t.Fatal("loss alert cleared with 1 of the last 5 pings lost")
+	}
+	testPing(t, -1, 2)
+	if testCount(t, db, `SELECT COUNT(*) FROM event WHERE type='loss_ok'`) != 1 || testCount(t, db, `SELECT loss_alert FROM device`) != 0 {
+		t.Fatal("no loss_ok once the pings come back")
+	}
+}
+
+func TestParseReportPing(t *testing.T) {
+	var cases map[string]bool
+	cases = map[string]bool{
+		`{"sent":3,"received":3,"loss":0,"rtt_min":1,"rtt_avg":2,"rtt_max":3,"jitter":1}`:               true,
+		`{"sent":3,"received":0,"loss":100,"rtt_min":null,"rtt_avg":null,"rtt_max":null,"jitter":null}`: true,
+		`{"sent":3,"received":0,"loss":100}`:                                                            true,
+		`{"sent":3,"received":0,"loss":100,"rtt_min":1,"rtt_avg":1,"rtt_max":1,"jitter":0}`:             false,
+		`{"sent":3,"received":0,"loss":50}`:                                                             false,
+		`{"sent":3,"received":2,"loss":33,"rtt_min":null,"rtt_avg":null,"rtt_max":null,"jitter":null}`:  false,
+		`{"sent":0,"received":0,"loss":100}`:                                                            false,
+		`{"sent":3,"loss":100}`:                                                                         false,
+	}
+
+	var input string
+	var ok bool
+	for input, ok = range cases {
+		var value interface{}
+		json.Unmarshal([]byte(input), &value)
+
+		var err error
+		_, err = ParseReportPing(value)
+		if (err == nil) != ok {
+			t.Errorf("%s: got %v", input, err)
+		}
+	}
+}
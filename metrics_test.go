@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testStream(response http.ResponseWriter, request *http.Request) {
+	Api(response, 200)
+}
+
+func TestStreamingLeftOutOfLatency(t *testing.T) {
+	testDb(t)
+
+	STREAMING_HANDLERS["testStream"] = true
+	t.Cleanup(func() { delete(STREAMING_HANDLERS, "testStream") })
+
+	MakeHandler(testStream)(httptest.NewRecorder(), httptest.NewRequest("GET", "/events/stream", nil))
+	MakeHandler(Report)(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/report", nil))
+
+	METRICS.Lock()
+	defer METRICS.Unlock()
+
+	if METRICS.Histograms["testStream"] != nil {
+		t.Fatal("stream timed into the latency histogram")
+	}
+	if METRICS.Histograms["Report"] == nil || METRICS.Histograms["Report"].Count == 0 {
+		t.Fatal("report not timed")
+	}
+}
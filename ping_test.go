@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParsePing(t *testing.T) {
+	var cases []map[string]interface{}
+	cases = []map[string]interface{}{
+		{
+			"name": "all replies",
+			"output": "PING 10.0.0.1 (10.0.0.1) 56(84) bytes of data.\n" +
+				"64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=1.00 ms\n" +
+				"64 bytes from 10.0.0.1: icmp_seq=2 ttl=64 time=3.00 ms\n" +
+				"64 bytes from 10.0.0.1: icmp_seq=3 ttl=64 time=2.00 ms\n" +
+				"\n--- 10.0.0.1 ping statistics ---\n" +
+				"3 packets transmitted, 3 received, 0% packet loss, time 402ms\n" +
+				"rtt min/avg/max/mdev = 1.000/2.000/3.000/0.816 ms\n",
+			"want": map[string]interface{}{"sent": 3, "received": 3, "loss": 0.0, "rtt_min": 1.0, "rtt_avg": 2.0, "rtt_max": 3.0, "jitter": 1.5},
+		},
+		{
+			"name": "one lost, busybox",
+			"output": "PING 10.0.0.1 (10.0.0.1): 56 data bytes\n" +
+				"64 bytes from 10.0.0.1: seq=0 ttl=64 time=0.500 ms\n" +
+				"64 bytes from 10.0.0.1: seq=2 ttl=64 time=0.700 ms\n" +
+				"\n--- 10.0.0.1 ping statistics ---\n" +
+				"3 packets transmitted, 2 packets received, 33% packet loss\n",
+			"want": map[string]interface{}{"sent": 3, "received": 2, "loss": 33.333, "rtt_min": 0.5, "rtt_avg": 0.6, "rtt_max": 0.7, "jitter": 0.2},
+		},
+		{
+			"name": "all lost",
+			"output": "PING 10.0.0.1 (10.0.0.1) 56(84) bytes of data.\n" +
+				"\n--- 10.0.0.1 ping statistics ---\n" +
+				"3 packets transmitted, 0 received, 100% packet loss, time 2043ms\n",
+			"want": map[string]interface{}{"sent": 3, "received": 0, "loss": 100.0, "rtt_min": nil, "rtt_avg": nil, "rtt_max": nil, "jitter": nil},
+		},
+		{
+			"name":   "all lost, no summary",
+			"output": "",
+			"want":   map[string]interface{}{"sent": 3, "received": 0, "loss": 100.0, "rtt_min": nil, "rtt_avg": nil, "rtt_max": nil, "jitter": nil},
+		},
+		{
+			"name": "reply cut off after time=",
+			"output": "64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=\n" +
+				"64 bytes from 10.0.0.1: icmp_seq=2 ttl=64 time=4 ms\n",
+			"want": map[string]interface{}{"sent": 3, "received": 1, "loss": 66.667, "rtt_min": 4.0, "rtt_avg": 4.0, "rtt_max": 4.0, "jitter": 0.0},
+		},
+		{
+			"name": "replies without times",
+			"output": "64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=\n" +
+				"1 packets transmitted, 1 received, 0% packet loss, time 0ms\n",
+			"want": map[string]interface{}(nil),
+		},
+	}
+
+	var item map[string]interface{}
+	for _, item = range cases {
+		var got map[string]interface{}
+		got = ParsePing(item["output"].(string), 3)
+		if fmt.Sprint(got) != fmt.Sprint(item["want"]) {
+			t.Errorf("%s: got %v, want %v", item["name"], got, item["want"])
+		}
+	}
+}
+
+func TestMergeLostPings(t *testing.T) {
+	PING_LOST.Lock()
+	PING_LOST.Lost["10.0.0.9"] = map[string]interface{}{"ip": "10.0.0.9", "ping": map[string]interface{}{"received": 0}}
+	PING_LOST.Lost["10.0.0.10"] = map[string]interface{}{"ip": "10.0.0.10", "ping": map[string]interface{}{"received": 0}}
+	PING_LOST.Unlock()
+
+	var devices []map[string]interface{}
+	devices = MergeLostPings([]map[string]interface{}{{"ip": "10.0.0.1"}})
+	if len(devices) != 3 || devices[0]["ip"] != "10.0.0.1" || devices[1]["ip"] != "10.0.0.10" || devices[2]["ip"] != "10.0.0.9" {
+		t.Fatalf("got %v", devices)
+	}
+
+	// each lost ping goes out once
+	devices = MergeLostPings(nil)
+	if len(devices) != 0 {
+		t.Fatalf("lost pings sent twice: %v", devices)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProbe records how many probes run at once and when each one started
+type fakeProbe struct {
+	mutex         sync.Mutex
+	in_flight     int
+	max_in_flight int
+	starts        []time.Time
+	sleep         time.Duration
+}
+
+func (fake *fakeProbe) Probe(ctx context.Context, ip string) map[string]interface{} {
+	fake.mutex.Lock()
+	fake.in_flight++
+	if fake.in_flight > fake.max_in_flight {
+		fake.max_in_flight = fake.in_flight
+	}
+	fake.starts = append(fake.starts, time.Now())
+	fake.mutex.Unlock()
+
+	var err error
+	select {
+	case <-time.After(fake.sleep):
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	fake.mutex.Lock()
+	fake.in_flight--
+	fake.mutex.Unlock()
+
+	return map[string]interface{}{"ip": ip, "err": err}
+}
+
+func fakeIps(count int) []string {
+	var ips []string
+	var i int
+	for i = 0; i < count; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i+1))
+	}
+	return ips
+}
+
+func TestProbeAllBoundsInFlight(t *testing.T) {
+	var fake *fakeProbe
+	fake = &fakeProbe{sleep: 20 * time.Millisecond}
+
+	var results []map[string]interface{}
+	results = ProbeAll(context.Background(), fakeIps(100), 8, nil, fake.Probe)
+
+	if len(results) != 100 {
+		t.Fatalf("got %d results, want 100", len(results))
+	}
+	if fake.max_in_flight > 8 {
+		t.Fatalf("%d probes in flight, want at most 8", fake.max_in_flight)
+	}
+	if fake.max_in_flight < 2 {
+		t.Fatalf("%d probes in flight, want the workers to run in parallel", fake.max_in_flight)
+	}
+}
+
+func TestProbeAllRate(t *testing.T) {
+	var fake *fakeProbe
+	fake = &fakeProbe{sleep: time.Millisecond}
+
+	// with a burst of 1 even the first probes are paced, 20 probes at 50/s
+	// take at least 19 intervals of 20ms
+	var start time.Time
+	start = time.Now()
+	ProbeAll(context.Background(), fakeIps(20), 64, NewTokenBucket(50, 1), fake.Probe)
+
+	var elapsed time.Duration
+	elapsed = time.Since(start)
+	if elapsed < 19*20*time.Millisecond*9/10 {
+		t.Fatalf("20 probes took %s, want at least %s at 50/s", elapsed, 19*20*time.Millisecond)
+	}
+
+	var i int
+	for i = 1; i < len(fake.starts); i++ {
+		if fake.starts[i].Sub(fake.starts[0]) < time.Duration(i)*20*time.Millisecond*8/10 {
+			t.Fatalf("probe %d started %s after the first, faster than 50/s", i, fake.starts[i].Sub(fake.starts[0]))
+		}
+	}
+}
+
+func TestProbeAllCancel(t *testing.T) {
+	var fake *fakeProbe
+	fake = &fakeProbe{sleep: time.Hour}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var start time.Time
+	start = time.Now()
+
+	var results []map[string]interface{}
+	results = ProbeAll(ctx, fakeIps(100), 4, nil, fake.Probe)
+
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("cancel took %s, in flight probes were not stopped", time.Since(start))
+	}
+	if len(results) > 4 {
+		t.Fatalf("got %d results, want only the probes in flight at cancel", len(results))
+	}
+
+	var result map[string]interface{}
+	for _, result = range results {
+		if result["err"] != context.DeadlineExceeded {
+			t.Fatalf("in flight probe saw %v, want the context to be cancelled", result["err"])
+		}
+	}
+}
+
+func TestExecCmdWithContextCancel(t *testing.T) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var start time.Time
+	start = time.Now()
+
+	var err error
+	_, err = ExecCmdWithContext(ctx, "sleep 5")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("sleep was not killed, took %s", time.Since(start))
+	}
+}
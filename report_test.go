@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDb points the server at an empty database of its own
+func testDb(t *testing.T) *sql.DB {
+	SETTINGS.DATA_SOURCE_NAME = filepath.Join(t.TempDir(), "test.db")
+	InitDb()
+
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testReport(t *testing.T, body string) int {
+	var request *http.Request
+	request = httptest.NewRequest("POST", "/api/report", strings.NewReader(body))
+
+	var recorder *httptest.ResponseRecorder
+	recorder = httptest.NewRecorder()
+	Report(recorder, request)
+	return recorder.Code
+}
+
+func testCount(t *testing.T, db *sql.DB, query string, args ...interface{}) int64 {
+	var count int64
+	var err error
+	err = db.QueryRow(query, args...).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestReportDropsDuplicateReplays(t *testing.T) {
+	var db *sql.DB
+	db = testDb(t)
+
+	var now string
+	var before string
+	now = time.Now().UTC().Format("2006-01-02 15:04:05")
+	before = time.Now().UTC().Add(-time.Minute).Format("2006-01-02 15:04:05")
+
+	var batch string
+	batch = `[
+		{"agent_id":"a1","ip":"10.0.0.1","mac":"aa:bb:cc:dd:ee:01","name":"one","heartbeat_time":"` + now + `"},
+		{"agent_id":"a1","ip":"10.0.0.2","mac":"aa:bb:cc:dd:ee:02","name":"two","heartbeat_time":"` + now + `"}
+	]`
+
+	// the agent never saw the first response and replays the same report
+	var i int
+	for i = 0; i < 2; i++ {
+		var code int
+		code = testReport(t, batch)
+		if code != 200 {
+			t.Fatalf("report %d got %d, want 200", i, code)
+		}
+	}
+
+	if testCount(t, db, `SELECT COUNT(*) FROM device_log`) != 2 {
+		t.Fatalf("%d heartbeats, want the replay dropped", testCount(t, db, `SELECT COUNT(*) FROM device_log`))
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM device`) != 2 {
+		t.Fatalf("%d devices, want 2", testCount(t, db, `SELECT COUNT(*) FROM device`))
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM event WHERE type='new'`) != 2 {
+		t.Fatal("replay added events")
+	}
+
+	// an older spooled report arriving late is kept but does not move the
+	// device back in time
+	var code int
+	code = testReport(t, `[{"agent_id":"a1","ip":"10.0.0.1","mac":"aa:bb:cc:dd:ee:01","name":"old","heartbeat_time":"`+before+`"}]`)
+	if code != 200 {
+		t.Fatalf("late report got %d, want 200", code)
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM device_log WHERE ip='10.0.0.1'`) != 2 {
+		t.Fatal("late report not logged")
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM device WHERE ip='10.0.0.1' AND name='one' AND heartbeat_time=?`, now) != 1 {
+		t.Fatal("late report moved the device back")
+	}
+}
+
+func TestReportRejectsInvalid(t *testing.T) {
+	testDb(t)
+
+	var body string
+	for _, body = range []string{
+		``,
+		`[]`,
+		`[{"agent_id":"a1","ip":"10.0.0.1","mac":"","name":""}]`,
+		`[{"agent_id":"a1","ip":"10.0.0.1","mac":"","name":"","heartbeat_time":"yesterday"}]`,
+	} {
+		var code int
+		code = testReport(t, body)
+		if code != 400 {
+			t.Fatalf("%q got %d, want 400", body, code)
+		}
+	}
+}
+
+func TestReportTooLarge(t *testing.T) {
+	var db *sql.DB
+	db = testDb(t)
+
+	var now string
+	now = time.Now().UTC().Format("2006-01-02 15:04:05")
+
+	// a valid batch, just one the server will not read to the end
+	var device string
+	device = `{"agent_id":"a1","ip":"10.0.0.1","mac":"","name":"","heartbeat_time":"` + now + `"}`
+
+	var body string
+	body = "[" + device + strings.Repeat(","+device, REPORT_MAX_BYTES/len(device)) + "]"
+
+	var code int
+	code = testReport(t, body)
+	if code != 413 {
+		t.Fatalf("got %d, want 413", code)
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM device_log`) != 0 {
+		t.Fatal("part of an oversized report was stored")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// the users and communities the fake agent answers to, one per mode
+var SNMP_TEST_CREDENTIALS = `
+127.0.0.1/32 v2c public
+127.0.0.1/32 v3 noauth
+127.0.0.1/32 v3 authmd5 md5 maplesyrup
+127.0.0.1/32 v3 privaes sha maplesyrup aes syrupmaple
+127.0.0.1/32 v3 privdes md5 maplesyrup des syrupmaple
+`
+
+// testSnmpFake runs SnmpFake on doc/snmp-switch.walk at a free port on
+// 127.0.0.1 and returns the credentials it answers to by version or user
+func testSnmpFake(t *testing.T) map[string]map[string]string {
+	var err error
+
+	SNMP_CREDENTIALS, err = ParseSnmpCredentials([]byte(SNMP_TEST_CREDENTIALS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SNMP_CREDENTIALS = nil })
+
+	var conn net.PacketConn
+	conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	port = conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	var snmp_port int
+	snmp_port = SETTINGS.SNMP_PORT
+	SETTINGS.SNMP_PORT = port
+	t.Cleanup(func() { SETTINGS.SNMP_PORT = snmp_port })
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+
+	var done chan error
+	done = make(chan error, 1)
+	go func() {
+		done <- SnmpFake(ctx, "127.0.0.1:"+strconv.Itoa(port), "doc/snmp-switch.walk")
+	}()
+	t.Cleanup(func() {
+		cancel()
+		var err error
+		err = <-done
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	var credentials map[string]map[string]string
+	credentials = make(map[string]map[string]string)
+	var credential map[string]string
+	for _, credential = range SNMP_CREDENTIALS {
+		if credential["version"] == "v2c" {
+			credentials["v2c"] = credential
+		} else {
+			credentials[credential["user"]] = credential
+		}
+	}
+
+	// the fake reads the walk before it listens
+	time.Sleep(100 * time.Millisecond)
+	return credentials
+}
+
+func testSnmpWalk(t *testing.T) []SnmpVarbind {
+	var err error
+
+	var data []byte
+	data, err = ioutil.ReadFile("doc/snmp-switch.walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var table []SnmpVarbind
+	table, err = ParseSnmpWalk(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) == 0 {
+		t.Fatal("empty walk")
+	}
+	return table
+}
+
+func TestSnmpFakeWalk(t *testing.T) {
+	var table []SnmpVarbind
+	table = testSnmpWalk(t)
+
+	var credentials map[string]map[string]string
+	credentials = testSnmpFake(t)
+
+	var name string
+	for _, name = range []string{"v2c", "noauth", "authmd5", "privaes", "privdes"} {
+		var err error
+
+		var client *SnmpClient
+		client, err = NewSnmpClient("127.0.0.1", credentials[name])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// the lldp tables sit under 1.0, the rest under 1.3
+		var varbinds []SnmpVarbind
+		var oid string
+		for _, oid = range []string{"1.0", "1.3"} {
+			var walked []SnmpVarbind
+			walked, err = client.Walk(oid)
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, oid, err)
+			}
+			varbinds = append(varbinds, walked...)
+		}
+		client.Close()
+		if fmt.Sprint(varbinds) != fmt.Sprint(table) {
+			t.Fatalf("%s: walked %d oids, want the %d of the fixture", name, len(varbinds), len(table))
+		}
+	}
+
+	// what a poll makes of the fixture over the encrypted session
+	var result map[string]interface{}
+	var err error
+	result, err = PollSnmp("127.0.0.1", credentials["privaes"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["sys_name"] != "sw1" || result["sys_descr"] != "Linux sw1 5.10.0 #1 SMP armv7l" || result["sys_object_id"] != "1.3.6.1.4.1.8072.3.2.10" || fmt.Sprint(result["sys_uptime"]) != "86400" {
+		t.Fatalf("system group: %v", result)
+	}
+	if len(result["interfaces"].([]map[string]interface{})) != 4 {
+		t.Fatalf("interfaces: %v", result["interfaces"])
+	}
+}
+
+func TestSnmpFakeRejects(t *testing.T) {
+	var credentials map[string]map[string]string
+	credentials = testSnmpFake(t)
+
+	var cases []map[string]string
+	cases = []map[string]string{
+		// a wrong community and a wrong password are dropped, the client
+		// times out
+		{"version": "v2c", "community": "private"},
+		{"version": "v3", "user": "authmd5", "auth": "md5", "auth_password": "pancakes1"},
+		// an unknown user and a security level the user does not have get
+		// a report
+		{"version": "v3", "user": "nobody"},
+		{"version": "v3", "user": "privaes", "auth": "sha", "auth_password": "maplesyrup"},
+		{"version": "v3", "user": "authmd5", "auth": "md5", "auth_password": "maplesyrup", "priv": "des", "priv_password": "syrupmaple"},
+	}
+
+	var credential map[string]string
+	for _, credential = range cases {
+		var err error
+
+		var client *SnmpClient
+		client, err = NewSnmpClient("127.0.0.1", credential)
+		if err == nil {
+			_, err = client.Request(SNMP_GET, []string{"1.3.6.1.2.1.1.5.0"}, 0, 0)
+			client.Close()
+		}
+		if err == nil {
+			t.Fatalf("%v: answered", credential)
+		}
+	}
+
+	// and the right ones still work afterwards
+	var err error
+	_, err = PollSnmp("127.0.0.1", credentials["privdes"])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// RFC 3414 A.3.1 and A.3.2
+func TestSnmpPasswordKey(t *testing.T) {
+	var engine_id []byte
+	engine_id, _ = hex.DecodeString("000000000000000000000002")
+
+	var cases map[string]string
+	cases = map[string]string{
+		"md5": "526f5eed9fcce26f8964c2930787d82b",
+		"sha": "6695febc9288e36282235fc7151f128497b38f3f",
+	}
+
+	var auth string
+	var want string
+	for auth, want = range cases {
+		var got string
+		got = hex.EncodeToString(SnmpPasswordKey(auth, "maplesyrup", engine_id))
+		if got != want {
+			t.Errorf("%s: got %s, want %s", auth, got, want)
+		}
+	}
+}
+
+func TestSnmpEncryptDecrypt(t *testing.T) {
+	var engine_id []byte
+	engine_id = []byte("engine")
+
+	var cases []map[string]string
+	cases = []map[string]string{
+		{"user": "u", "auth": "md5", "auth_password": "maplesyrup", "priv": "des", "priv_password": "syrupmaple"},
+		{"user": "u", "auth": "sha", "auth_password": "maplesyrup", "priv": "des", "priv_password": "syrupmaple"},
+		{"user": "u", "auth": "md5", "auth_password": "maplesyrup", "priv": "aes", "priv_password": "syrupmaple"},
+		{"user": "u", "auth": "sha", "auth_password": "maplesyrup", "priv": "aes", "priv_password": "syrupmaple"},
+	}
+
+	var credential map[string]string
+	for _, credential = range cases {
+		var user *SnmpUser
+		user = SnmpLocalize(credential, engine_id)
+
+		var n int
+		for _, n = range []int{0, 1, 7, 8, 9, 100} {
+			var err error
+
+			var plain []byte
+			plain = bytes.Repeat([]byte{0x30}, n)
+
+			var data []byte
+			var salt []byte
+			data, salt, err = SnmpEncrypt(user, 3, 12345, plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 0 && bytes.Contains(data, plain) {
+				t.Fatalf("%s %d: not encrypted", user.Priv, n)
+			}
+
+			var output []byte
+			output, err = SnmpDecrypt(user, 3, 12345, salt, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// des pads to the block, BER does not mind the trailing zeros
+			if !bytes.Equal(output[:n], plain) {
+				t.Fatalf("%s %d: got %x, want %x", user.Priv, n, output, plain)
+			}
+
+			// a second message never reuses the salt
+			var salt2 []byte
+			_, salt2, _ = SnmpEncrypt(user, 3, 12345, plain)
+			if bytes.Equal(salt, salt2) {
+				t.Fatalf("%s: salt reused", user.Priv)
+			}
+
+			_, err = SnmpDecrypt(user, 3, 12345, salt[:4], data)
+			if err == nil {
+				t.Fatalf("%s: short salt accepted", user.Priv)
+			}
+		}
+	}
+}
+
+// every prefix of an encoded message must fail to decode without panicking
+func TestSnmpDecodeTruncated(t *testing.T) {
+	var credential map[string]string
+	credential = map[string]string{"user": "u", "auth": "sha", "auth_password": "maplesyrup", "priv": "aes", "priv_password": "syrupmaple"}
+
+	var user *SnmpUser
+	user = SnmpLocalize(credential, []byte("engine"))
+
+	var msg *SnmpMessage
+	msg = &SnmpMessage{
+		Version:   3,
+		MsgId:     7,
+		Flags:     7,
+		EngineId:  []byte("engine"),
+		Boots:     1,
+		Time:      2,
+		User:      "u",
+		PduType:   SNMP_GET,
+		RequestId: 9,
+		Varbinds:  []SnmpVarbind{{Oid: "1.3.6.1.2.1.1.5.0", Type: BER_NULL}},
+	}
+
+	var err error
+
+	var data []byte
+	data, err = SnmpEncode(msg, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookup func(name string) *SnmpUser
+	lookup = func(name string) *SnmpUser { return user }
+
+	var output *SnmpMessage
+	output, err = SnmpDecode(data, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.RequestId != 9 || fmt.Sprint(output.Varbinds) != fmt.Sprint(msg.Varbinds) {
+		t.Fatalf("got %+v", output)
+	}
+
+	var n int
+	for n = 0; n < len(data); n++ {
+		_, err = SnmpDecode(data[:n], lookup)
+		if err == nil {
+			t.Fatalf("%d of %d bytes decoded", n, len(data))
+		}
+	}
+
+	// a flipped bit anywhere fails the authentication
+	var i int
+	for i = 0; i < len(data); i++ {
+		var broken []byte
+		broken = append([]byte(nil), data...)
+		broken[i] ^= 0x01
+		_, err = SnmpDecode(broken, lookup)
+		if err == nil {
+			t.Fatalf("bit flipped at %d accepted", i)
+		}
+	}
+}
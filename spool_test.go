@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures reports with 503 and takes the rest,
+// remembering every attempt in order
+type flakyServer struct {
+	mutex    sync.Mutex
+	failures int
+	status   int
+	attempts []string
+	queries  []string
+	times    []time.Time
+	accepted []string
+}
+
+func (flaky *flakyServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var body []byte
+	body, _ = ioutil.ReadAll(request.Body)
+
+	flaky.mutex.Lock()
+	defer flaky.mutex.Unlock()
+
+	flaky.attempts = append(flaky.attempts, string(body))
+	flaky.queries = append(flaky.queries, request.URL.RawQuery)
+	flaky.times = append(flaky.times, time.Now())
+	if len(flaky.attempts) <= flaky.failures {
+		response.WriteHeader(flaky.status)
+		return
+	}
+	flaky.accepted = append(flaky.accepted, string(body))
+	response.Write([]byte(`{"code":200,"msg":"OK"}`))
+}
+
+func testSpool(t *testing.T, handler http.Handler) {
+	var server *httptest.Server
+	server = httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	SETTINGS.API = server.URL
+	SETTINGS.SPOOL = t.TempDir()
+	SETTINGS.SPOOL_MAX_FILES = 10080
+	SETTINGS.SPOOL_MAX_AGE = 7 * 24 * time.Hour
+}
+
+func TestSpoolReplayAfterOutage(t *testing.T) {
+	var flaky *flakyServer
+	flaky = &flakyServer{failures: 2, status: 503}
+	testSpool(t, flaky)
+
+	var i int
+	for i = 0; i < 3; i++ {
+		var err error
+		err = SpoolWrite([]byte(fmt.Sprintf(`[{"batch":%d}]`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	var trigger chan struct{}
+	trigger = make(chan struct{}, 1)
+	go SpoolLoop(ctx, trigger)
+	trigger <- struct{}{}
+
+	var deadline time.Time
+	deadline = time.Now().Add(10 * time.Second)
+	for len(SpoolFiles()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("spool not drained, %d files left", len(SpoolFiles()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	flaky.mutex.Lock()
+	defer flaky.mutex.Unlock()
+
+	// the outage blocks the queue at the oldest report, nothing jumps ahead
+	var want []string
+	want = []string{`[{"batch":0}]`, `[{"batch":0}]`, `[{"batch":0}]`, `[{"batch":1}]`, `[{"batch":2}]`}
+	if fmt.Sprint(flaky.attempts) != fmt.Sprint(want) {
+		t.Fatalf("attempts %v, want %v", flaky.attempts, want)
+	}
+	if fmt.Sprint(flaky.accepted) != fmt.Sprint(want[2:]) {
+		t.Fatalf("accepted %v, want %v", flaky.accepted, want[2:])
+	}
+
+	// 1s after the first failure, then twice that
+	var gaps []time.Duration
+	gaps = []time.Duration{flaky.times[1].Sub(flaky.times[0]), flaky.times[2].Sub(flaky.times[1])}
+	if gaps[0] < 900*time.Millisecond || gaps[1] < 1900*time.Millisecond {
+		t.Fatalf("retries after %v, want a backoff of 1s then 2s", gaps)
+	}
+}
+
+func TestSpoolDropsRejected(t *testing.T) {
+	var flaky *flakyServer
+	flaky = &flakyServer{failures: 1, status: 400}
+	testSpool(t, flaky)
+
+	SpoolWrite([]byte(`[{"batch":0}]`))
+	SpoolWrite([]byte(`[{"batch":1}]`))
+
+	if !SpoolFlush(context.Background()) {
+		t.Fatal("spool not drained")
+	}
+	if fmt.Sprint(flaky.accepted) != fmt.Sprint([]string{`[{"batch":1}]`}) {
+		t.Fatalf("accepted %v, want only the second batch", flaky.accepted)
+	}
+}
+
+func TestSpoolAcksWakes(t *testing.T) {
+	var flaky *flakyServer
+	flaky = &flakyServer{failures: 1, status: 503}
+	testSpool(t, flaky)
+
+	WAKE_ACKS.Lock()
+	WAKE_ACKS.Results["7"] = "sent"
+	WAKE_ACKS.Results["12"] = "failed"
+	WAKE_ACKS.Unlock()
+
+	SpoolWrite([]byte(`[{"batch":0}]`))
+
+	// the acknowledgment is kept until a report that carried it is taken
+	if SpoolFlush(context.Background()) || len(WakeAcks()) != 2 {
+		t.Fatalf("acks %v dropped with a failed report", WakeAcks())
+	}
+	if !SpoolFlush(context.Background()) || len(WakeAcks()) != 0 {
+		t.Fatalf("acks %v kept after the report was taken", WakeAcks())
+	}
+	if fmt.Sprint(flaky.queries) != "[wakes=12%3Afailed%2C7%3Asent wakes=12%3Afailed%2C7%3Asent]" {
+		t.Fatalf("queries %v", flaky.queries)
+	}
+}
+
+func TestSpoolTrim(t *testing.T) {
+	testSpool(t, http.NotFoundHandler())
+	SETTINGS.SPOOL_MAX_FILES = 5
+
+	// a report from before -spool-max-age
+	var err error
+	err = ioutil.WriteFile(filepath.Join(SETTINGS.SPOOL, fmt.Sprintf("%020d.json", time.Now().Add(-8*24*time.Hour).UnixNano())), []byte(`[]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written []string
+	var i int
+	for i = 0; i < 8; i++ {
+		err = SpoolWrite([]byte(`[]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = SpoolFiles()
+	}
+
+	SpoolTrim()
+
+	var files []string
+	files = SpoolFiles()
+	if len(files) != 5 {
+		t.Fatalf("%d files after trim, want 5", len(files))
+	}
+	if fmt.Sprint(files) != fmt.Sprint(written[len(written)-5:]) {
+		t.Fatalf("kept %v, want the newest %v", files, written[len(written)-5:])
+	}
+
+	var file string
+	for _, file = range files {
+		_, err = os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
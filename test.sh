@@ -0,0 +1,17 @@
+#!/bin/bash
+
+set -e
+set -o pipefail
+set -u
+set -x
+
+cd "$(dirname "$0")"
+
+date
+
+# both binaries are package main in one directory, so each is tested with
+# its own files
+GO111MODULE=off go test -count=1 lnx801cli.go probe_test.go spool_test.go client_test.go decode_test.go snmp_test.go import_test.go ping_test.go
+GO111MODULE=off go test -count=1 lnx801srv.go report_test.go token_test.go tls_test.go login_test.go time_test.go metrics_test.go wake_test.go loss_test.go
+
+date
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// legacy local times around both DST changes of 2026 in Berlin: 02:00-03:00
+// on 29 March does not exist, 02:00-03:00 on 25 October happens twice
+var DST_TIMES = []map[string]string{
+	{"local": "2026-03-29 01:30:00", "utc": "2026-03-29 00:30:00"},
+	{"local": "2026-03-29 02:30:00", "utc": "2026-03-29 01:30:00"},
+	{"local": "2026-03-29 03:30:00", "utc": "2026-03-29 01:30:00"},
+	{"local": "2026-10-25 01:30:00", "utc": "2026-10-24 23:30:00"},
+	{"local": "2026-10-25 02:30:00", "utc": "2026-10-25 01:30:00"},
+	{"local": "2026-10-25 03:30:00", "utc": "2026-10-25 02:30:00"},
+}
+
+func testBerlin(t *testing.T) *time.Location {
+	var err error
+
+	var loc *time.Location
+	loc, err = time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+
+	var local *time.Location
+	local = time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = local })
+	return loc
+}
+
+func TestDbTime(t *testing.T) {
+	var loc *time.Location
+	loc = testBerlin(t)
+
+	var input time.Time
+	input = time.Date(2026, 7, 1, 12, 0, 0, 0, loc)
+	if DbTime(input) != "2026-07-01 10:00:00" {
+		t.Fatalf("got %s, want UTC", DbTime(input))
+	}
+	if DbTime(input.UTC()) != DbTime(input) {
+		t.Fatal("same instant stored differently")
+	}
+}
+
+func TestParseHeartbeatTime(t *testing.T) {
+	testBerlin(t)
+
+	var item map[string]string
+	for _, item = range DST_TIMES {
+		var output time.Time
+		var err error
+		output, err = ParseHeartbeatTime(item["local"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if DbTime(output) != item["utc"] {
+			t.Fatalf("%s got %s, want %s", item["local"], DbTime(output), item["utc"])
+		}
+	}
+
+	// current agents send RFC3339, the server zone does not matter then
+	var value string
+	for _, value = range []string{"2026-10-25T01:30:00Z", "2026-10-25T02:30:00+01:00", "2026-10-25T03:30:00+02:00"} {
+		var output time.Time
+		var err error
+		output, err = ParseHeartbeatTime(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if DbTime(output) != "2026-10-25 01:30:00" {
+			t.Fatalf("%s got %s", value, DbTime(output))
+		}
+	}
+
+	var err error
+	_, err = ParseHeartbeatTime("25.10.2026 02:30")
+	if err == nil {
+		t.Fatal("invalid time accepted")
+	}
+}
+
+func TestMigrateUtc(t *testing.T) {
+	var loc *time.Location
+	loc = testBerlin(t)
+
+	var db *sql.DB
+	db = testDb(t)
+
+	var err error
+
+	var item map[string]string
+	for _, item = range DST_TIMES {
+		_, err = db.Exec(`INSERT INTO device_log (agent_id, ip, mac, name, heartbeat_time) VALUES ('a1', '10.0.0.1', '', '', ?)`, item["local"])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`INSERT INTO device (agent_id, ip, mac, name, heartbeat_time) VALUES ('a1', '10.0.0.1', '', '', ?)`, DST_TIMES[1]["local"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	MigrateUtc(loc)
+
+	var check = func() {
+		var rows *sql.Rows
+		rows, err = db.Query(`SELECT CAST(heartbeat_time AS TEXT) FROM device_log ORDER BY id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var index int
+		for rows.Next() {
+			var value string
+			err = rows.Scan(&value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != DST_TIMES[index]["utc"] {
+				t.Fatalf("%s migrated to %s, want %s", DST_TIMES[index]["local"], value, DST_TIMES[index]["utc"])
+			}
+			index++
+		}
+		if index != len(DST_TIMES) {
+			t.Fatalf("%d rows, want %d", index, len(DST_TIMES))
+		}
+		if testCount(t, db, `SELECT COUNT(*) FROM device WHERE heartbeat_time=?`, DST_TIMES[1]["utc"]) != 1 {
+			t.Fatal("device not migrated")
+		}
+	}
+	check()
+
+	// a second run must refuse and leave the rows alone
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("second migration ran")
+			}
+		}()
+		MigrateUtc(loc)
+	}()
+	check()
+
+	// an old agent replaying its spool after the migration hits the rows it
+	// already sent, the skipped hour included
+	var before int64
+	before = testCount(t, db, `SELECT COUNT(*) FROM device_log`)
+	for _, item = range DST_TIMES {
+		var code int
+		code = testReport(t, `[{"agent_id":"a1","ip":"10.0.0.1","mac":"","name":"","heartbeat_time":"`+item["local"]+`"}]`)
+		if code != 200 {
+			t.Fatalf("replay of %s got %d", item["local"], code)
+		}
+	}
+	if testCount(t, db, `SELECT COUNT(*) FROM device_log`) != before {
+		t.Fatal("replayed legacy heartbeats were not recognised as duplicates")
+	}
+}
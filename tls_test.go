@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCerts issues a server certificate for 127.0.0.1 and an agent
+// certificate from one CA, and an agent certificate from another
+func testCerts(t *testing.T) (string, string) {
+	var err error
+
+	var dir string
+	var other string
+	dir = t.TempDir()
+	other = t.TempDir()
+
+	var ca_cert *x509.Certificate
+	var ca_key *ecdsa.PrivateKey
+	ca_cert, ca_key, err = LoadOrCreateCa(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IssueCert(dir, ca_cert, ca_key, "server", []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IssueCert(dir, ca_cert, ca_key, "agent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an agent certificate that ran out, signed by the right CA
+	{
+		var key *ecdsa.PrivateKey
+		var der []byte
+		key, der, err = GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var template2 x509.Certificate
+		template2 = x509.Certificate{
+			SerialNumber: NewSerialNumber(),
+			Subject:      pkix.Name{CommonName: "expired"},
+			NotBefore:    time.Now().AddDate(-2, 0, 0),
+			NotAfter:     time.Now().AddDate(-1, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+
+		var cert_der []byte
+		cert_der, err = x509.CreateCertificate(rand.Reader, &template2, ca_cert, &key.PublicKey, ca_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		WritePem(filepath.Join(dir, "expired.key"), "EC PRIVATE KEY", der, 0600)
+		WritePem(filepath.Join(dir, "expired.crt"), "CERTIFICATE", cert_der, 0644)
+	}
+
+	ca_cert, ca_key, err = LoadOrCreateCa(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IssueCert(other, ca_cert, ca_key, "agent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, other
+}
+
+func testTlsClient(t *testing.T, dir string, cert_dir string, name string) *http.Client {
+	var err error
+
+	var data []byte
+	data, err = ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config *tls.Config
+	config = &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AppendCertsFromPEM(data)
+
+	if name != "" {
+		var pair tls.Certificate
+		pair, err = tls.LoadX509KeyPair(filepath.Join(cert_dir, name+".crt"), filepath.Join(cert_dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+}
+
+func testTlsServer(t *testing.T, dir string, client_auth string) *httptest.Server {
+	var err error
+
+	var mux *http.ServeMux
+	mux = http.NewServeMux()
+	mux.HandleFunc("/api/report", MakeHandler(func(response http.ResponseWriter, request *http.Request) { Api(response, 200) }))
+	mux.HandleFunc("/login", MakeHandler(func(response http.ResponseWriter, request *http.Request) { Api(response, 200) }))
+
+	var server *httptest.Server
+	server = httptest.NewUnstartedServer(mux)
+	server.TLS, err = TlsConfig(filepath.Join(dir, "ca.crt"), client_auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pair tls.Certificate
+	pair, err = tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.Certificates = []tls.Certificate{pair}
+
+	SETTINGS.TLS_CLIENT_REQUIRED = client_auth == "require"
+	t.Cleanup(func() { SETTINGS.TLS_CLIENT_REQUIRED = false })
+
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testTlsPost(client *http.Client, url string, token string) (int, error) {
+	var err error
+
+	var request *http.Request
+	request, err = http.NewRequest("POST", url, strings.NewReader(`[]`))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("token", token)
+
+	var response *http.Response
+	response, err = client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+func TestTlsClientCert(t *testing.T) {
+	testDb(t)
+
+	var err error
+
+	var token string
+	_, token, err = CreateToken("agent", "report", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dir string
+	var other string
+	dir, other = testCerts(t)
+
+	var server *httptest.Server
+	server = testTlsServer(t, dir, "require")
+
+	var code int
+
+	code, err = testTlsPost(testTlsClient(t, dir, dir, "agent"), server.URL+"/api/report", token)
+	if err != nil || code != 200 {
+		t.Fatalf("agent with certificate got %d %v, want 200", code, err)
+	}
+
+	code, err = testTlsPost(testTlsClient(t, dir, dir, ""), server.URL+"/api/report", token)
+	if err != nil || code != 401 {
+		t.Fatalf("agent without certificate got %d %v, want 401", code, err)
+	}
+
+	// browsers bring no certificate and must still reach the dashboard
+	var response *http.Response
+	response, err = testTlsClient(t, dir, dir, "").Get(server.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		t.Fatalf("login without certificate got %d, want 200", response.StatusCode)
+	}
+
+	// certificates that do not verify never finish the handshake
+	_, err = testTlsPost(testTlsClient(t, dir, other, "agent"), server.URL+"/api/report", token)
+	if err == nil {
+		t.Fatal("certificate from another CA accepted")
+	}
+	_, err = testTlsPost(testTlsClient(t, dir, dir, "expired"), server.URL+"/api/report", token)
+	if err == nil {
+		t.Fatal("expired certificate accepted")
+	}
+}
+
+func TestTlsClientCertVerify(t *testing.T) {
+	testDb(t)
+
+	var err error
+
+	var token string
+	_, token, err = CreateToken("agent", "report", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dir string
+	var other string
+	dir, other = testCerts(t)
+
+	var server *httptest.Server
+	server = testTlsServer(t, dir, "verify")
+
+	var code int
+	code, err = testTlsPost(testTlsClient(t, dir, dir, ""), server.URL+"/api/report", token)
+	if err != nil || code != 200 {
+		t.Fatalf("agent without certificate got %d %v, want 200", code, err)
+	}
+
+	_, err = testTlsPost(testTlsClient(t, dir, other, "agent"), server.URL+"/api/report", token)
+	if err == nil {
+		t.Fatal("certificate from another CA accepted")
+	}
+
+	_, err = TlsConfig(filepath.Join(dir, "ca.crt"), "maybe")
+	if err == nil {
+		t.Fatal("invalid client auth accepted")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testAuthenticate(token string) map[string]interface{} {
+	var request *http.Request
+	request = httptest.NewRequest("GET", "/api/v1/devices", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	return Authenticate(request)
+}
+
+func TestAuthenticate(t *testing.T) {
+	var db *sql.DB
+	db = testDb(t)
+
+	var err error
+
+	var id int64
+	var token string
+	id, token, err = CreateToken("agent", "report", "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = CreateToken("other", "read", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var matched map[string]interface{}
+	matched = testAuthenticate(token)
+	if matched == nil || matched["id"].(int64) != id || matched["agent_id"] != "a1" {
+		t.Fatalf("got %v, want token %d", matched, id)
+	}
+	if testAuthenticate(token+"x") != nil || testAuthenticate("") != nil {
+		t.Fatal("wrong token accepted")
+	}
+
+	// only the first use within a minute is written
+	_, err = db.Exec(`UPDATE api_token SET last_used_time=NULL WHERE id=?`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAuthenticate(token)
+	if testCount(t, db, `SELECT COUNT(*) FROM api_token WHERE id=? AND last_used_time IS NULL`, id) != 1 {
+		t.Fatal("last_used_time written again within a minute")
+	}
+
+	err = RevokeToken(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testAuthenticate(token) != nil {
+		t.Fatal("revoked token accepted")
+	}
+}
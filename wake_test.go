@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWakeReport reports 10.0.0.1 for agent a1 with the given wake
+// acknowledgments and returns the ids of the wakes relayed back
+func testWakeReport(t *testing.T, acks string) []int64 {
+	var now string
+	now = time.Now().UTC().Format("2006-01-02 15:04:05")
+
+	var target string
+	target = "/api/report"
+	if acks != "" {
+		target += "?wakes=" + acks
+	}
+
+	var recorder *httptest.ResponseRecorder
+	recorder = httptest.NewRecorder()
+	Report(recorder, httptest.NewRequest("POST", target, strings.NewReader(`[{"agent_id":"a1","ip":"10.0.0.1","mac":"aa:bb:cc:dd:ee:01","name":"one","heartbeat_time":"`+now+`"}]`)))
+	if recorder.Code != 200 {
+		t.Fatalf("report got %d", recorder.Code)
+	}
+
+	var response struct {
+		Data struct {
+			Commands []struct {
+				Id int64 `json:"id"`
+			} `json:"commands"`
+		} `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+
+	var ids []int64
+	ids = make([]int64, 0)
+	var i int
+	for i = range response.Data.Commands {
+		ids = append(ids, response.Data.Commands[i].Id)
+	}
+	return ids
+}
+
+func TestRelayWakes(t *testing.T) {
+	var db *sql.DB
+	db = testDb(t)
+
+	testWakeReport(t, "")
+
+	var err error
+
+	var device map[string]interface{}
+	device, err = LoadDevice(db, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wake map[string]interface{}
+	wake, err = RequestWake(db, device, "agent", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id int64
+	id = wake["id"].(int64)
+
+	var status = func() string {
+		var status string
+		err = db.QueryRow(`SELECT status FROM wake WHERE id=?`, id).Scan(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if fmt.Sprint(testWakeReport(t, "")) != fmt.Sprint([]int64{id}) || status() != "relayed" {
+		t.Fatalf("wake not relayed: %s", status())
+	}
+
+	// the agent has not had the time to acknowledge it yet
+	if len(testWakeReport(t, "")) != 0 {
+		t.Fatal("wake relayed twice within the retry window")
+	}
+
+	// the response that carried it got lost, it goes out again
+	_, err = db.Exec(`UPDATE wake SET send_time=? WHERE id=?`, DbTime(time.Now().Add(-WAKE_RELAY_RETRY-time.Second)), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(testWakeReport(t, "")) != fmt.Sprint([]int64{id}) {
+		t.Fatal("unacknowledged wake not relayed again")
+	}
+
+	// results other than sent and failed and garbage are ignored
+	testWakeReport(t, fmt.Sprintf("%d:online,x:sent,%d", id, id))
+	if status() != "relayed" {
+		t.Fatalf("bad acknowledgment settled the wake: %s", status())
+	}
+
+	_, err = db.Exec(`UPDATE wake SET send_time=? WHERE id=?`, DbTime(time.Now().Add(-WAKE_RELAY_RETRY-time.Second)), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testWakeReport(t, fmt.Sprintf("%d:sent", id))) != 0 || status() != "sent" {
+		t.Fatalf("acknowledged wake relayed again: %s", status())
+	}
+}